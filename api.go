@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Administrative HTTP API, authenticated with the API token as bearer token:
+//
+//   GET  /api/stats                             returns statistics, like those of the rendition cache
+//   GET  /api/metadata/<hash>                   returns the metadata of the avatar
+//   GET  /api/versions/<hash>                   lists the previous versions of the avatar
+//   POST /api/versions/<hash>/<version>/revert  makes the version the current avatar
+
+var (
+	apiMetadataRegExp = regexp.MustCompile("^metadata/([0-9a-f]+)$")
+	apiVersionsRegExp = regexp.MustCompile("^versions/([0-9a-f]+)$")
+	apiRevertRegExp   = regexp.MustCompile("^versions/([0-9a-f]+)/([0-9]+)/revert$")
+)
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if !isValidToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing API token")
+		return
+	}
+	if title == "stats" && r.Method == "GET" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"renditionCache": renditions.stats(),
+			"coalescedRequests": inflight.sharedRequests(), "imageWork": imageWork.stats()})
+		return
+	}
+	if m := apiMetadataRegExp.FindStringSubmatch(title); m != nil && r.Method == "GET" {
+		key := createAvatarPath(resolveHash(m[1]))
+		if !keyExists(key) {
+			writeJSONError(w, http.StatusNotFound, "avatar not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, readMetadata(key))
+		return
+	}
+	if m := apiVersionsRegExp.FindStringSubmatch(title); m != nil && r.Method == "GET" {
+		versions, err := getVersions(resolveHash(m[1]))
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if versions == nil {
+			versions = []Version{}
+		}
+		writeJSON(w, http.StatusOK, versions)
+		return
+	}
+	if m := apiRevertRegExp.FindStringSubmatch(title); m != nil && r.Method == "POST" {
+		if err := revertAvatar(resolveHash(m[1]), m[2]); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"reverted": m[2]})
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "unknown API call")
+}
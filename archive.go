@@ -0,0 +1,591 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archives contain the data of all stores with a manifest. Entries are named independently of the storage
+// layout: avatars/<hash>, unconfirmed/<token>-<hash>, versions/<hash>/<version>, userimages/<user>/<userimage>,
+// aliases/<alias>, emails/<hash>, openids/<hash> and profiles/<hash>, with the sidecars next to them. The manifest is the last
+// entry, so that the archive can be written in a single pass.
+
+const (
+	manifestName  = "manifest.json"
+	archiveFormat = 1
+)
+
+// Manifest of an archive
+type manifest struct {
+	Format  int               `json:"format"`
+	Created time.Time         `json:"created"`
+	Avatars []archivedAvatar  `json:"avatars"`
+	Pending []archivedPending `json:"pending"`
+	Files   []archivedFile    `json:"files"`
+}
+
+type archivedAvatar struct {
+	Hash     string    `json:"hash"`
+	Metadata Metadata  `json:"metadata"`
+	Versions []Version `json:"versions"`
+}
+
+type archivedPending struct {
+	Token    string   `json:"token"`
+	Hash     string   `json:"hash"`
+	Metadata Metadata `json:"metadata"`
+}
+
+type archivedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Key in the storage with its name in the archive
+type archiveKey struct {
+	name string
+	key  string
+}
+
+// Returns the keys of all data that is archived. Transient data, like history links, is not archived.
+func listArchiveKeys() ([]archiveKey, error) {
+	var keys []archiveKey
+	for _, dir := range []string{"avatars", getUnconfirmedDir()} {
+		sharded, err := listShardedKeys(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range sharded {
+			keys = append(keys, archiveKey{path.Join(dir, path.Base(key)), key})
+		}
+	}
+	for _, dir := range []string{"aliases", "emails", "openids", "profiles"} {
+		sharded, err := listShardedKeys(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range sharded {
+			keys = append(keys, archiveKey{path.Join(dir, path.Base(key)), key})
+		}
+	}
+	for _, dir := range []string{"versions", "userimages"} {
+		subdirs, err := listShardedDirs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, subdir := range subdirs {
+			names, err := storage.List(subdir)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				keys = append(keys, archiveKey{path.Join(dir, path.Base(subdir), name), path.Join(subdir, name)})
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Returns the storage key for the name of an entry in an archive
+func archiveNameToKey(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid name '%s' in archive", name)
+		}
+	}
+	base := strings.SplitN(parts[len(parts)-1], ".", 2)
+	suffix := strings.TrimPrefix(parts[len(parts)-1], base[0])
+	switch {
+	case len(parts) == 2 && parts[0] == "avatars":
+		return createAvatarPath(base[0]) + suffix, nil
+	case len(parts) == 2 && parts[0] == getUnconfirmedDir():
+		splitted := strings.SplitN(base[0], "-", 2)
+		if len(splitted) != 2 {
+			return "", fmt.Errorf("invalid name '%s' in archive", name)
+		}
+		return createUnconfirmedAvatarPath(splitted[1], splitted[0]) + suffix, nil
+	case len(parts) == 2 && (parts[0] == "aliases" || parts[0] == "emails" || parts[0] == "openids" ||
+		parts[0] == "profiles"):
+		return createStorePath(parts[0], parts[1]), nil
+	case len(parts) == 3 && (parts[0] == "versions" || parts[0] == "userimages"):
+		return path.Join(getStoreDir(parts[0], parts[1]), parts[2]), nil
+	}
+	return "", fmt.Errorf("unexpected name '%s' in archive", name)
+}
+
+func checksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Writes all data to the archive
+func exportArchive(w io.Writer) (*manifest, error) {
+	keys, err := listArchiveKeys()
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{Format: archiveFormat, Created: time.Now().UTC(), Avatars: []archivedAvatar{},
+		Pending: []archivedPending{}, Files: []archivedFile{}}
+	// the sidecars of avatars are read together with the avatar
+	avatars := map[string]bool{}
+	for _, k := range keys {
+		if dir, name := path.Split(k.name); dir == "avatars/" && !strings.Contains(name, ".") {
+			avatars[name] = true
+		}
+	}
+	tw := tar.NewWriter(w)
+	for _, k := range keys {
+		dir, name := path.Split(k.name)
+		hash := strings.SplitN(name, ".", 2)[0]
+		if dir == "avatars/" && avatars[hash] && (name == hash+metadataSuffix || name == hash+originalSuffix) {
+			continue // exported with the avatar
+		}
+		if dir == "avatars/" && name == hash {
+			files, err := readExportedAvatar(k.key)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if err := writeArchiveEntry(tw, k.name+file.suffix, file.data, m.Created); err != nil {
+					return nil, err
+				}
+				m.Files = append(m.Files, archivedFile{Name: k.name + file.suffix, Size: int64(len(file.data)),
+					SHA256: checksum(file.data)})
+			}
+			if len(files) == 0 {
+				continue // removed while exporting
+			}
+			versions, err := getVersions(name)
+			if err != nil {
+				return nil, err
+			}
+			var metadata []byte
+			if len(files) > 1 && files[1].suffix == metadataSuffix {
+				metadata = files[1].data
+			}
+			m.Avatars = append(m.Avatars, archivedAvatar{Hash: name, Metadata: parseMetadata(k.key, metadata),
+				Versions: versions})
+			continue
+		}
+
+		data, err := readKey(k.key)
+		if os.IsNotExist(err) {
+			continue // removed while exporting
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := writeArchiveEntry(tw, k.name, data, m.Created); err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, archivedFile{Name: k.name, Size: int64(len(data)), SHA256: checksum(data)})
+
+		if strings.Contains(name, ".") {
+			continue
+		}
+		switch dir {
+		case getUnconfirmedDir() + "/":
+			splitted := strings.SplitN(name, "-", 2)
+			if len(splitted) == 2 {
+				m.Pending = append(m.Pending, archivedPending{Token: splitted[0], Hash: splitted[1], Metadata: readMetadata(k.key)})
+			}
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeArchiveEntry(tw, manifestName, data, m.Created); err != nil {
+		return nil, err
+	}
+	return m, tw.Close()
+}
+
+// File of an avatar, the avatar itself has an empty suffix
+type avatarFile struct {
+	suffix string
+	data   []byte
+}
+
+// How often an avatar is read again when it changed while it was read
+const exportRetries = 10
+
+// Reads the avatar at key together with its sidecars, returns no files if the avatar doesn't exist (anymore). The
+// export runs without the locks of the service, so the avatar may be replaced while it is read. Since the sidecars
+// are written before the avatar, this is detected by reading the metadata before and after the other files and by
+// comparing the checksum in the metadata with the avatar. A changed avatar is read again.
+func readExportedAvatar(key string) ([]avatarFile, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := readOptionalKey(createMetadataPath(key))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readOptionalKey(key)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		original, err := readOptionalKey(key + originalSuffix)
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := readOptionalKey(createMetadataPath(key))
+		if err != nil {
+			return nil, err
+		}
+		sum := parseMetadata(key, metadata).Checksum
+		if bytes.Equal(before, metadata) && (before == nil) == (metadata == nil) && (sum == "" || sum == checksum(data)) {
+			files := []avatarFile{{"", data}}
+			if metadata != nil {
+				files = append(files, avatarFile{metadataSuffix, metadata})
+			}
+			if original != nil {
+				files = append(files, avatarFile{originalSuffix, original})
+			}
+			return files, nil
+		}
+		if attempt == exportRetries {
+			return nil, fmt.Errorf("%s keeps changing while it is exported", key)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Reads the key, returns nil data if it doesn't exist
+func readOptionalKey(key string) ([]byte, error) {
+	data, err := readKey(key)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if data == nil && err == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Calls fn for every entry in the archive, except the manifest which is returned
+func readArchive(filename string, fn func(name string, data []byte) error) (*manifest, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var m *manifest
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == manifestName {
+			m = &manifest{}
+			if err := json.Unmarshal(data, m); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %v", err)
+			}
+			continue
+		}
+		if err := fn(header.Name, data); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, errors.New("archive has no manifest")
+	}
+	if m.Format != archiveFormat {
+		return nil, fmt.Errorf("unsupported archive format %d", m.Format)
+	}
+	return m, nil
+}
+
+// Verifies the entries of the archive against the checksums of the manifest
+func verifyArchive(filename string) (*manifest, error) {
+	checksums := map[string]string{}
+	m, err := readArchive(filename, func(name string, data []byte) error {
+		if _, err := archiveNameToKey(name); err != nil {
+			return err
+		}
+		checksums[name] = checksum(data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range m.Files {
+		sum, ok := checksums[file.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing in the archive", file.Name)
+		}
+		if sum != file.SHA256 {
+			return nil, fmt.Errorf("checksum of %s does not match the manifest", file.Name)
+		}
+		delete(checksums, file.Name)
+	}
+	for name := range checksums {
+		return nil, fmt.Errorf("%s is not listed in the manifest", name)
+	}
+	return m, nil
+}
+
+// Result of an import
+type importReport struct {
+	removed         int // existing keys removed by replace
+	avatarsAdded    int
+	avatarsReplaced int // local avatar was older
+	avatarsKept     int // local avatar was newer
+	versionsAdded   int
+	pendingAdded    int
+	filesAdded      int // other files, like aliases and profiles
+	filesKept       int // existing files that are not overwritten (includes versions and pending uploads)
+}
+
+func (r importReport) String() string {
+	return fmt.Sprintf("removed existing keys:    %d\n"+
+		"avatars added:            %d\n"+
+		"avatars replaced (newer): %d\n"+
+		"avatars kept (older):     %d\n"+
+		"versions added:           %d\n"+
+		"pending uploads added:    %d\n"+
+		"other files added:        %d\n"+
+		"existing files kept:      %d",
+		r.removed, r.avatarsAdded, r.avatarsReplaced, r.avatarsKept, r.versionsAdded, r.pendingAdded, r.filesAdded,
+		r.filesKept)
+}
+
+// Imports the archive. With replace all existing data is removed first, otherwise the archive is merged: an avatar
+// that exists on both sides is replaced if the archived avatar was confirmed later (the replaced avatar is kept as
+// previous version), otherwise the archived avatar is added as previous version. Other existing data is kept. With
+// dryRun nothing is changed, only the report is created.
+func importArchive(filename string, replace bool, dryRun bool) (*importReport, error) {
+	m, err := verifyArchive(filename)
+	if err != nil {
+		return nil, err
+	}
+	report := &importReport{}
+
+	// decide which avatars are imported, the archived avatars that are older than the local ones are imported as
+	// previous version (named by their confirmation time)
+	imported := map[string]bool{}
+	versioned := map[string]string{}
+	checksums := map[string]string{}
+	for _, file := range m.Files {
+		checksums[file.Name] = file.SHA256
+	}
+	for _, avatar := range m.Avatars {
+		current := createAvatarPath(avatar.Hash)
+		switch {
+		case replace || !keyExists(current):
+			report.avatarsAdded++
+			imported[avatar.Hash] = true
+		case avatar.Metadata.modified().After(readMetadata(current).modified()):
+			report.avatarsReplaced++
+			imported[avatar.Hash] = true
+		default:
+			report.avatarsKept++
+			if isNewVersion(avatar.Hash, checksums["avatars/"+avatar.Hash]) {
+				report.versionsAdded++
+				imported[avatar.Hash] = true
+				versioned[avatar.Hash] = fmt.Sprintf("%d", avatar.Metadata.modified().UnixNano())
+			}
+		}
+	}
+
+	if replace {
+		keys, err := listArchiveKeys()
+		if err != nil {
+			return nil, err
+		}
+		report.removed = len(keys)
+		if !dryRun {
+			for _, k := range keys {
+				if err := storage.Remove(k.key); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// imported avatars are staged first, and replace the current avatars when they are complete
+	var staged []string
+	for hash := range imported {
+		if dryRun {
+			break
+		}
+		// left behind by an interrupted import
+		if err := removeAvatar(createImportPath(hash)); err != nil {
+			return nil, err
+		}
+	}
+	_, err = readArchive(filename, func(name string, data []byte) error {
+		key, err := archiveNameToKey(name)
+		if err != nil {
+			return err
+		}
+		dir, base := path.Split(name)
+		hash := strings.SplitN(base, ".", 2)[0]
+		if dir == "avatars/" {
+			if !imported[hash] || dryRun {
+				return nil
+			}
+			if base == hash {
+				staged = append(staged, hash)
+			}
+			return storage.Write(createImportPath(hash)+strings.TrimPrefix(base, hash), data)
+		}
+		if !replace && keyExists(key) {
+			report.filesKept++
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(dir, "versions/"):
+			if !strings.Contains(base, ".") {
+				report.versionsAdded++
+			}
+		case dir == getUnconfirmedDir()+"/":
+			if !strings.Contains(base, ".") {
+				report.pendingAdded++
+			}
+		default:
+			report.filesAdded++
+		}
+		if dryRun {
+			return nil
+		}
+		return storage.Write(key, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range staged {
+		if version, ok := versioned[hash]; ok {
+			err = addImportedVersion(hash, version)
+		} else {
+			err = replaceWithImported(hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func createImportPath(hash string) string {
+	return path.Join("imports", hash)
+}
+
+// Replaces the current avatar of the hash by the staged imported avatar, the archived avatar may not have all
+// sidecars of the current avatar
+func replaceWithImported(hash string) error {
+	defer lockAvatar(hash)()
+	return replaceCurrentAvatar(hash, func(key string) error {
+		return moveAvatar(createImportPath(hash), key)
+	})
+}
+
+// Returns true if no avatar with the checksum is the current avatar of the hash or one of its versions, which is the
+// case when the same archive is imported again
+func isNewVersion(hash string, sum string) bool {
+	if *history <= 0 || sum == storedChecksum(createAvatarPath(hash)) {
+		return false
+	}
+	versions, err := getVersions(hash)
+	if err != nil {
+		log.Printf("Error reading versions of %s: %v", hash, err)
+	}
+	for _, version := range versions {
+		if sum == storedChecksum(createVersionPath(hash, version.ID)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the checksum of the stored avatar, avatars stored by older versions may have no checksum in their metadata
+func storedChecksum(key string) string {
+	if sum := readMetadata(key).Checksum; sum != "" {
+		return sum
+	}
+	return checksum(readAvatarData(key))
+}
+
+// Adds the staged imported avatar as previous version of the hash
+func addImportedVersion(hash string, version string) error {
+	defer lockAvatar(hash)()
+	log.Printf("Keeping imported avatar %s as version %s", hash, version)
+	if err := moveAvatar(createImportPath(hash), createVersionPath(hash, version)); err != nil {
+		return err
+	}
+	return pruneVersions(hash)
+}
+
+func exportCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var w io.Writer = os.Stdout
+	if args[0] != "-" {
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	m, err := exportArchive(w)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d avatars and %d pending uploads (%d files)", len(m.Avatars), len(m.Pending), len(m.Files))
+	return nil
+}
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	replace := flags.Bool("replace", false, "")
+	dryRun := flags.Bool("dry-run", false, "")
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	report, err := importArchive(flags.Arg(0), *replace, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Println("Dry run, nothing has been changed")
+	}
+	fmt.Println(report)
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exports the current storage to a file in dir
+func exportToFile(t *testing.T, dir string) string {
+	b := new(bytes.Buffer)
+	if _, err := exportArchive(b); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "export.tar")
+	if err := ioutil.WriteFile(filename, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intravatar-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	replaceAvatar(t, hash, "pg")
+	pending := createUnconfirmedAvatarPath(hash, "0123456789abcdef")
+	if err := writeAvatar(pending, nil, &Avatar{data: []byte("pending")}, Metadata{Rating: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeProfile(createProfilePath(hash), &Profile{DisplayName: "Someone"}); err != nil {
+		t.Fatal(err)
+	}
+	filename := exportToFile(t, dir)
+
+	cleanup()
+	defer useTempStorage(t)()
+	report, err := importArchive(filename, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.avatarsAdded != 1 || report.versionsAdded != 1 || report.pendingAdded != 1 || report.filesAdded != 1 {
+		t.Errorf("Unexpected dry run report:\n%v", report)
+	}
+	if keyExists(createAvatarPath(hash)) {
+		t.Errorf("Dry run should not import the avatar")
+	}
+
+	if _, err := importArchive(filename, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if readMetadata(createAvatarPath(hash)).Rating != "pg" || !keyExists(pending) || !keyExists(createProfilePath(hash)) {
+		t.Errorf("Expected avatar, pending upload and profile to be imported")
+	}
+	if versions, _ := getVersions(hash); len(versions) != 1 {
+		t.Errorf("Expected imported version, got %v", versions)
+	}
+
+	// the local avatar is newer than the archived one
+	replaceAvatar(t, hash, "r")
+	report, err = importArchive(filename, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.avatarsKept != 1 || readMetadata(createAvatarPath(hash)).Rating != "r" {
+		t.Errorf("Expected newer local avatar to be kept:\n%v", report)
+	}
+	report, err = importArchive(filename, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.avatarsAdded != 1 || readMetadata(createAvatarPath(hash)).Rating != "pg" {
+		t.Errorf("Expected avatar to be replaced:\n%v", report)
+	}
+}
+
+func TestImportOlderAvatarAsVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intravatar-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(n int, age time.Duration) { *history, *historyMaxAge = n, age }(*history, *historyMaxAge)
+	*history = 5
+	*historyMaxAge = 0
+
+	// the avatar is confirmed on one instance and later on another instance
+	hash := createHash("someone@example.com")
+	confirmed := time.Now().Add(-time.Hour).UTC()
+	cleanup := useTempStorage(t)
+	defer cleanup()
+	archived := createPortrait(32, 32)
+	if err := writeAvatar(createAvatarPath(hash), nil, archived, Metadata{Rating: "pg", Confirmed: confirmed}); err != nil {
+		t.Fatal(err)
+	}
+	filename := exportToFile(t, dir)
+
+	cleanup()
+	defer useTempStorage(t)()
+	local := createPortrait(48, 48)
+	if err := writeAvatar(createAvatarPath(hash), nil, local, Metadata{Rating: "g", Confirmed: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		report, err := importArchive(filename, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.avatarsKept != 1 || report.versionsAdded != 1-i {
+			t.Errorf("Unexpected report of import %d:\n%v", i+1, report)
+		}
+	}
+	if metadata := readMetadata(createAvatarPath(hash)); metadata.Rating != "g" || metadata.Checksum != checksum(local.data) {
+		t.Errorf("Expected newer local avatar to be kept, got %+v", metadata)
+	}
+	versions, err := getVersions(hash)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("Expected archived avatar as the only version, got %v (%v)", versions, err)
+	}
+	if !versions[0].Replaced.Equal(confirmed) || versions[0].Metadata.Rating != "pg" ||
+		checksum(readAvatarData(createVersionPath(hash, versions[0].ID))) != checksum(archived.data) {
+		t.Errorf("Unexpected version %+v", versions[0])
+	}
+}
+
+func TestImportVerifiesChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intravatar-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, cleanup := setupDataDir(t)
+	defer cleanup()
+	filename := exportToFile(t, dir)
+
+	data, _ := ioutil.ReadFile(filename)
+	// corrupt the first entry, the (red) avatar
+	idx := bytes.Index(data, []byte("IDAT"))
+	data[idx+8] ^= 0xff
+	ioutil.WriteFile(filename, data, 0600)
+	if _, err := importArchive(filename, false, true); err == nil {
+		t.Errorf("Expected import of corrupted archive to fail")
+	}
+}
+
+func TestExportReadsChangedAvatarAgain(t *testing.T) {
+	defer useTempStorage(t)()
+	hash := createHash("someone@example.com")
+	key := createAvatarPath(hash)
+	if err := writeAvatar(key, nil, createPortrait(32, 32), Metadata{Rating: "pg"}); err != nil {
+		t.Fatal(err)
+	}
+	// the metadata of the next avatar is written, but the avatar itself not yet
+	next := createPortrait(48, 48)
+	if err := writeMetadata(key, Metadata{Rating: "g", Checksum: checksum(next.data)}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		writeToStorage(key, next)
+	}()
+	m, err := exportArchive(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Avatars) != 1 || m.Avatars[0].Metadata.Rating != "g" {
+		t.Fatalf("Expected the metadata of the next avatar, got %+v", m.Avatars)
+	}
+	for _, file := range m.Files {
+		if file.Name == "avatars/"+hash && file.SHA256 != checksum(next.data) {
+			t.Errorf("Expected the next avatar to be exported with its metadata")
+		}
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"image/png"
 	"io"
 	"log"
+	"mime"
+	"net/http"
+	"strings"
 )
 
 func min(x, y int) int {
@@ -28,17 +31,42 @@ func max(x, y int) int {
 
 // Avatar image with some metadata
 type Avatar struct {
-	size int
-	data []byte
+	size   int
+	data   []byte
+	format string // format of data, if known
 	// below are used in header fields
 	cacheControl string
 	lastModified string
+	etag         string
+}
+
+// Returns the content type of the avatar, or an empty string if it is not known
+func (avatar *Avatar) contentType() string {
+	if avatar.format != "" {
+		return "image/" + avatar.format
+	}
+	if avatar.data != nil {
+		return http.DetectContentType(avatar.data)
+	}
+	return ""
+}
+
+// Returns the format of an image content type, like png for image/png, or an empty string if it is not an image
+func contentTypeFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return ""
+	}
+	return strings.TrimPrefix(mediaType, "image/")
 }
 
 func avatar2Image(avatar *Avatar) (img image.Image, format string, err error) {
 	return image.Decode(bytes.NewBuffer(avatar.data))
 }
 
+// Formats in which avatars are served, these are the formats that image2Avatar can encode
+var avatarFormats = map[string]bool{"jpeg": true, "png": true, "gif": true}
+
 // alters the avatar instance!
 func image2Avatar(avatar *Avatar, img image.Image, format string) {
 	b := new(bytes.Buffer)
@@ -51,6 +79,7 @@ func image2Avatar(avatar *Avatar, img image.Image, format string) {
 		png.Encode(b, img)
 	}
 	avatar.data = b.Bytes()
+	avatar.format = format
 }
 
 // scales the avatar (altering it!)
@@ -71,30 +100,39 @@ func scale(avatar *Avatar, size int, requestFormat string) error {
 	return nil
 }
 
-func cropAndScale(avatar *Avatar) error {
-	img, format, err := avatar2Image(avatar)
+// Creates the master from the original: the image is cropped to a square and scaled down to maxSize. The
+// master is encoded as png, so that renditions don't suffer from repeated lossy compression.
+func cropAndScale(original *Avatar) (*Avatar, error) {
+	img, format, err := avatar2Image(original)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	original.format = format
 	x := img.Bounds().Dx()
 	y := img.Bounds().Dy()
 	size := min(x, y)
 	if x != y {
-		log.Printf("Cropping img from %vx%v to %vx%v", x, y, size, size)
-		img, err = cutter.Crop(img, cutter.Config{
+		log.Printf("Cropping img from %vx%v to %vx%v (%s)", x, y, size, size, *crop)
+		config := cutter.Config{
 			Width:  size,
 			Height: size,
-			Mode:   cutter.Centered})
+			Mode:   cutter.Centered}
+		if *crop == "top" {
+			config.Mode = cutter.TopLeft
+			config.Anchor = image.Point{X: img.Bounds().Min.X + (x-size)/2, Y: img.Bounds().Min.Y}
+		}
+		img, err = cutter.Crop(img, config)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	if size > maxSize {
-		log.Printf("Resizing img from %vx%v to %vx%v", size, size, maxSize, maxSize)
-		img = resize.Resize(uint(maxSize), uint(maxSize), img, resize.Bicubic)
+	if size > *maxSize {
+		log.Printf("Resizing img from %vx%v to %vx%v", size, size, *maxSize, *maxSize)
+		img = resize.Resize(uint(*maxSize), uint(*maxSize), img, resize.Bicubic)
 	}
-	image2Avatar(avatar, img, format)
-	return nil
+	master := &Avatar{size: min(size, *maxSize)}
+	image2Avatar(master, img, "png")
+	return master, nil
 }
 
 func strictReadImage(reader io.Reader) (*Avatar, error) {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// portrait image with a red top half and a blue bottom half
+func createPortrait(width, height int) *Avatar {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if y < height/2 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	b := new(bytes.Buffer)
+	jpeg.Encode(b, img, nil)
+	return &Avatar{size: -1, data: b.Bytes()}
+}
+
+func TestCropAndScale(t *testing.T) {
+	defer func(size int, mode string) { *maxSize, *crop = size, mode }(*maxSize, *crop)
+	*maxSize = 64
+
+	original := createPortrait(100, 300)
+	master, err := cropAndScale(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original.format != "jpeg" || master.format != "png" {
+		t.Errorf("Expected jpeg original and png master, got %s and %s", original.format, master.format)
+	}
+	img, _, err := avatar2Image(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Errorf("Expected master of 64x64, got %v", img.Bounds())
+	}
+
+	*crop = "top"
+	master, err = cropAndScale(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, _ = avatar2Image(master)
+	if !isRed(img) {
+		t.Errorf("Expected the red top of the image when cropping the top")
+	}
+}
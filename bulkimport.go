@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Avatars can be imported by an administrator from a directory of images named <email>.<extension>, or from a CSV
+// file with lines <email>,<path or url>. Imported avatars don't require confirmation.
+
+// Returned by storeAdminAvatar if there is an avatar and it may not be overwritten
+var errAvatarExists = errors.New("avatar already exists")
+
+// Stores the image as avatar of the email without confirmation. An existing avatar is only replaced if overwrite is
+// true, it is then kept as previous version.
+func storeAdminAvatar(email string, image io.Reader, rating string, overwrite bool) error {
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("'%s' is not an email address", email)
+	}
+	original, master, err := validateAndResize(context.Background(), image)
+	if err == errBusy {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("invalid image: %v", err)
+	}
+	hash := createHash(email)
+	defer lockAvatar(hash)()
+	key := createAvatarPath(hash)
+	if !overwrite && keyExists(key) {
+		return errAvatarExists
+	}
+	if err := registerAliases(email); err != nil {
+		return err
+	}
+	if err := registerEmail(email); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	return replaceCurrentAvatar(hash, func(key string) error {
+		return writeAvatar(key, original, master, Metadata{Rating: rating, Email: email, Uploaded: now, Confirmed: now})
+	})
+}
+
+// Source of an avatar in a bulk import
+type importSource struct {
+	email    string
+	location string // file name or url
+}
+
+func (s importSource) open() (io.ReadCloser, error) {
+	if strings.HasPrefix(s.location, "http://") || strings.HasPrefix(s.location, "https://") {
+		resp, err := http.Get(s.location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s returned %s", s.location, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(s.location)
+}
+
+// Returns the images in the directory, the email being the file name without extension
+func readImportDir(dir string) ([]importSource, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sources []importSource
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		email := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		sources = append(sources, importSource{normalizeEmail(email), filepath.Join(dir, file.Name())})
+	}
+	return sources, nil
+}
+
+// Reads the CSV file with lines <email>,<path or url>, relative paths are relative to the CSV file. A header line is
+// skipped.
+func readImportCSV(filename string) ([]importSource, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var sources []importSource
+	for idx, record := range records {
+		email, location := normalizeEmail(record[0]), strings.TrimSpace(record[1])
+		if idx == 0 && !strings.Contains(email, "@") {
+			continue
+		}
+		if !strings.Contains(location, "://") && !filepath.IsAbs(location) {
+			location = filepath.Join(filepath.Dir(filename), location)
+		}
+		sources = append(sources, importSource{email, location})
+	}
+	return sources, nil
+}
+
+// Result of a bulk import
+type bulkImportReport struct {
+	imported   int
+	existing   int      // not overwritten
+	duplicates []string // emails that occur more than once, only the first one is imported
+	rejected   []string // with the reason
+}
+
+func (r bulkImportReport) String() string {
+	lines := []string{fmt.Sprintf("imported: %d, existing (kept): %d, duplicates: %d, rejected: %d",
+		r.imported, r.existing, len(r.duplicates), len(r.rejected))}
+	for _, duplicate := range r.duplicates {
+		lines = append(lines, "duplicate: "+duplicate)
+	}
+	for _, rejected := range r.rejected {
+		lines = append(lines, "rejected: "+rejected)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func bulkImport(sources []importSource, rating string, overwrite bool) bulkImportReport {
+	var report bulkImportReport
+	seen := map[string]bool{}
+	for _, source := range sources {
+		hash := createHash(source.email)
+		if seen[hash] {
+			report.duplicates = append(report.duplicates, fmt.Sprintf("%s (%s)", source.email, source.location))
+			continue
+		}
+		seen[hash] = true
+		image, err := source.open()
+		if err == nil {
+			err = storeAdminAvatar(source.email, image, rating, overwrite)
+			image.Close()
+		}
+		switch err {
+		case nil:
+			log.Printf("Imported avatar for %s from %s", source.email, source.location)
+			report.imported++
+		case errAvatarExists:
+			report.existing++
+		default:
+			report.rejected = append(report.rejected, fmt.Sprintf("%s (%s): %v", source.email, source.location, err))
+		}
+	}
+	return report
+}
+
+func bulkImportCommand(args []string) error {
+	flags := flag.NewFlagSet("bulk-import", flag.ContinueOnError)
+	overwrite := flags.Bool("overwrite", false, "")
+	rating := flags.String("rating", defaultRating, "")
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || validRating(*rating) == "" {
+		return errUsage
+	}
+	source := flags.Arg(0)
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	var sources []importSource
+	if info.IsDir() {
+		sources, err = readImportDir(source)
+	} else {
+		sources, err = readImportCSV(source)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(bulkImport(sources, validRating(*rating), *overwrite))
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBulkImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intravatar-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	image := createPortrait(40, 60).data
+	for name, data := range map[string][]byte{
+		"new@example.com.jpg":     image,
+		"New@Example.com.png":     image,
+		"someone@example.com.jpg": image,
+		"broken@example.com.jpg":  []byte("not an image"),
+		"no-email.jpg":            image,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources, err := readImportDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := bulkImport(sources, "g", false)
+	if report.imported != 1 || report.existing != 1 || len(report.duplicates) != 1 || len(report.rejected) != 2 {
+		t.Errorf("Unexpected report:\n%v", report)
+	}
+	if metadata := readMetadata(createAvatarPath(createHash("new@example.com"))); metadata.Email != "new@example.com" {
+		t.Errorf("Expected imported avatar for new@example.com, got metadata %v", metadata)
+	}
+	if readMetadata(createAvatarPath(hash)).Email != "" {
+		t.Errorf("Existing avatar should not be overwritten")
+	}
+
+	csv := "email,image\nsomeone@example.com, someone@example.com.jpg\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "import.csv"), []byte(csv), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sources, err = readImportCSV(filepath.Join(dir, "import.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := bulkImport(sources, "pg", true); report.imported != 1 {
+		t.Errorf("Unexpected report:\n%v", report)
+	}
+	if metadata := readMetadata(createAvatarPath(hash)); metadata.Rating != "pg" || metadata.Email != "someone@example.com" {
+		t.Errorf("Expected existing avatar to be overwritten, got metadata %v", metadata)
+	}
+}
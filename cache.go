@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+// Scaled renditions of local avatars are cached, since decoding, scaling and encoding dominate the cost of a request.
+// The cache is bounded by the total size of the cached images, the least recently used renditions are evicted.
+// Renditions are stored with the checksum of the avatar they were rendered from, and only returned for that checksum.
+// This way an avatar that is replaced by another process, like the revert command or another instance that shares the
+// storage, is noticed by the checksum in its metadata. Changes in this process invalidate the renditions directly.
+
+// Key of a rendition, the hash being the resolved hash
+type renditionKey struct {
+	hash   string
+	size   int
+	format string
+}
+
+type renditionEntry struct {
+	key    renditionKey
+	source string // checksum of the avatar the rendition is rendered from
+	avatar *Avatar
+}
+
+type renditionCache struct {
+	mutex    sync.Mutex
+	maxBytes int
+	bytes    int
+	entries  map[renditionKey]*list.Element
+	lru      *list.List // of *renditionEntry, most recently used first
+	// incremented on every invalidation, renditions that were created before are not added
+	generation int64
+	hits       int64
+	misses     int64
+}
+
+// Statistics of the cache
+type cacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int   `json:"bytes"`
+}
+
+// The cache is disabled until it is configured
+var renditions = newRenditionCache(0)
+
+func newRenditionCache(maxBytes int) *renditionCache {
+	return &renditionCache{maxBytes: maxBytes, entries: map[renditionKey]*list.Element{}, lru: list.New()}
+}
+
+// Returns the cached rendition (which must not be altered) of the avatar with the source checksum or nil, and the
+// generation to pass to add. A rendition of another avatar is removed.
+func (c *renditionCache) get(key renditionKey, source string) (*Avatar, int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		if entry := element.Value.(*renditionEntry); entry.source == source {
+			c.hits++
+			c.lru.MoveToFront(element)
+			return entry.avatar, c.generation
+		}
+		c.remove(element)
+	}
+	c.misses++
+	return nil, c.generation
+}
+
+// Returns the cached rendition (which must not be altered) of the avatar with the source checksum or nil, without
+// counting it as hit or miss
+func (c *renditionCache) peek(key renditionKey, source string) *Avatar {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok && element.Value.(*renditionEntry).source == source {
+		return element.Value.(*renditionEntry).avatar
+	}
+	return nil
+}
+
+// Adds the rendition of the avatar with the source checksum, unless the cache has been invalidated since the
+// generation was obtained
+func (c *renditionCache) add(key renditionKey, source string, avatar *Avatar, generation int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation || len(avatar.data) > c.maxBytes {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&renditionEntry{key, source, avatar})
+	c.bytes += len(avatar.data)
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *renditionCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*renditionEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.avatar.data)
+}
+
+// Removes all renditions of the hash
+func (c *renditionCache) invalidate(hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	for key, element := range c.entries {
+		if key.hash == hash {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *renditionCache) stats() cacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return cacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries), Bytes: c.bytes}
+}
+
+// Logs the statistics of the cache at the interval, if they changed
+func logCacheStats(interval time.Duration) {
+	var last cacheStats
+	for range time.Tick(interval) {
+		stats := renditions.stats()
+		if stats != last {
+			log.Printf("Rendition cache: %d hits, %d misses, %d entries, %d bytes", stats.Hits, stats.Misses,
+				stats.Entries, stats.Bytes)
+			last = stats
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRenditionCache(t *testing.T) {
+	c := newRenditionCache(10)
+	a := renditionKey{hash: "a", size: 80}
+	b := renditionKey{hash: "b", size: 80}
+	_, generation := c.get(a, "s")
+	c.add(a, "s", &Avatar{data: make([]byte, 4)}, generation)
+	c.add(b, "s", &Avatar{data: make([]byte, 4)}, generation)
+	if avatar, _ := c.get(a, "s"); avatar == nil {
+		t.Fatal("Expected cached rendition")
+	}
+	// b is least recently used
+	c.add(renditionKey{hash: "c", size: 80}, "s", &Avatar{data: make([]byte, 4)}, generation)
+	if avatar, _ := c.get(b, "s"); avatar != nil {
+		t.Errorf("Expected least recently used rendition to be evicted")
+	}
+
+	_, generation = c.get(b, "s")
+	c.invalidate("a")
+	if avatar, _ := c.get(a, "s"); avatar != nil {
+		t.Errorf("Expected invalidated rendition to be removed")
+	}
+	c.add(b, "s", &Avatar{data: make([]byte, 4)}, generation)
+	if avatar, _ := c.get(b, "s"); avatar != nil {
+		t.Errorf("Rendition created before invalidation should not be added")
+	}
+	if stats := c.stats(); stats.Hits != 1 || stats.Entries != 1 || stats.Bytes != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// the rendition of another source is removed
+	c.add(b, "s", &Avatar{data: make([]byte, 4)}, c.generation)
+	if avatar, _ := c.get(b, "other"); avatar != nil {
+		t.Errorf("Expected no rendition for other source")
+	}
+	if avatar, _ := c.get(b, "s"); avatar != nil {
+		t.Errorf("Expected rendition of other source to be removed")
+	}
+}
+
+func TestRenditionCacheInvalidatedOnConfirm(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(c *renditionCache) { renditions = c }(renditions)
+	renditions = newRenditionCache(1 << 20)
+
+	decodeResponse(t, requestAvatar("/avatar/"+hash))
+	decodeResponse(t, requestAvatar("/avatar/"+hash))
+	if stats := renditions.stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected one hit and one miss, got %+v", stats)
+	}
+
+	pending := createUnconfirmedAvatarPath(hash, "0123456789abcdef")
+	if err := writeAvatar(pending, nil, createPortrait(64, 64), Metadata{Rating: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := promoteAvatar(pending, hash); err != nil {
+		t.Fatal(err)
+	}
+	if img := decodeResponse(t, requestAvatar("/avatar/"+hash)); isRed(img) {
+		t.Errorf("Expected the confirmed avatar instead of the cached one")
+	}
+}
+
+func TestRenditionCacheNoticesReplacementByOtherProcess(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(c *renditionCache) { renditions = c }(renditions)
+	renditions = newRenditionCache(1 << 20)
+	key := createAvatarPath(hash)
+	if err := writeAvatar(key, nil, createPortrait(64, 64), Metadata{Rating: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	decodeResponse(t, requestAvatar("/avatar/"+hash))
+
+	// replaced without invalidating the cache of this process, like the revert command would
+	next := createPortrait(48, 48)
+	if err := storage.Write(key+metadataSuffix, []byte(`{"rating":"g","checksum":"`+checksum(next.data)+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if w := requestAvatar("/avatar/" + hash); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	if stats := renditions.stats(); stats.Hits != 0 || stats.Entries != 0 {
+		t.Errorf("Expected no cached rendition while the avatar is replaced, got %+v", stats)
+	}
+	if err := storage.Write(key, next.data); err != nil {
+		t.Fatal(err)
+	}
+	w := requestAvatar("/avatar/" + hash)
+	if w.Header().Get("ETag") != createETag(checksum(next.data), Request{size: 80}) {
+		t.Errorf("Expected the next avatar")
+	}
+	if stats := renditions.stats(); stats.Hits != 0 || stats.Entries != 1 {
+		t.Errorf("Expected the rendition of the next avatar to be cached, got %+v", stats)
+	}
+}
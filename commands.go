@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Administrative command, invoked as 'intravatar [options] <command> [arguments]'
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// Returned by a command when it is invoked with invalid arguments
+var errUsage = errors.New("invalid arguments")
+
+var commands = map[string]command{
+	"regenerate":  {"regenerate  Recreates the avatars from their original uploads using the current max-size and crop", regenerateCommand},
+	"history":     {"history <hash>  Lists the previous versions of the avatar", historyCommand},
+	"revert":      {"revert <hash> <version>  Makes the previous version the current avatar", revertCommand},
+	"prune":       {"prune  Removes the previous versions that exceed history or history-max-age and expired history links", pruneCommand},
+	"info":        {"info <hash>  Shows the metadata of the avatar and its pending uploads", infoCommand},
+	"metadata":    {"metadata  Creates the metadata of avatars that were stored without it", metadataCommand},
+	"migrate":     {"migrate  Migrates the storage to the sharded layout (can also be done online with -migrate)", migrateCommand},
+	"export":      {"export <file>  Exports all data to a tar archive ('-' for stdout)", exportCommand},
+	"import":      {"import [-replace] [-dry-run] <file>  Imports a tar archive, merging it with the existing data unless -replace is given", importCommand},
+	"bulk-import": {"bulk-import [-overwrite] [-rating=<rating>] <dir or csv>  Imports avatars from a directory of <email>.<ext> images or a CSV file of <email>,<path or url>", bulkImportCommand},
+	"prerender":   {"prerender  Renders the missing renditions of prerender-sizes and removes outdated ones", prerenderCommand},
+	"openid":      {"openid <url> [<email>]  Registers the email address of the owner of the OpenID URL, without email the owner is removed", openIDCommand},
+	"backfill":    {"backfill <file>  Registers the emails in file (one per line, '-' for stdin) with their SHA-256 aliases", backfillCommand},
+}
+
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var usages []string
+		for _, c := range commands {
+			usages = append(usages, "    "+c.usage)
+		}
+		sort.Strings(usages)
+		return fmt.Errorf("unknown command '%s', available commands:\n%s", args[0], strings.Join(usages, "\n"))
+	}
+	err := cmd.run(args[1:])
+	if err == errUsage {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	return err
+}
+
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(filename)
+}
+
+// Returns the hashes of all avatars
+func listAvatars() ([]string, error) {
+	keys, err := listShardedKeys("avatars")
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, key := range keys {
+		if name := path.Base(key); !strings.Contains(name, ".") {
+			hashes = append(hashes, name)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// Registers the SHA-256 aliases for avatars that were stored before SHA-256 hashes were supported. Since only the
+// MD5 hash is stored, this requires the email addresses to be known. The emails are registered as well, which is
+// required for federation.
+func backfillCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	input, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	withAvatar, withoutAvatar := 0, 0
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		email := normalizeEmail(scanner.Text())
+		if email == "" {
+			continue
+		}
+		// the email is also registered if there is no avatar, so that it can be used for federation
+		if err := registerAliases(email); err != nil {
+			return err
+		}
+		if err := registerEmail(email); err != nil {
+			return err
+		}
+		if keyExists(createAvatarPath(createHash(email))) {
+			withAvatar++
+		} else {
+			withoutAvatar++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log.Printf("Registered %d emails with avatar and %d emails without avatar", withAvatar, withoutAvatar)
+	return nil
+}
+
+// Recreates the stored avatars from their originals, for example after max-size or crop has been changed. Avatars
+// that were uploaded before originals were kept are left untouched.
+func regenerateCommand(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	names, err := listAvatars()
+	if err != nil {
+		return err
+	}
+	regenerated, skipped := 0, 0
+	for _, name := range names {
+		key := createAvatarPath(name)
+		data, err := readKey(key + originalSuffix)
+		if os.IsNotExist(err) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		master, err := cropAndScale(&Avatar{size: -1, data: data})
+		if err != nil {
+			log.Printf("Failed to regenerate avatar %s: %v", name, err)
+			skipped++
+			continue
+		}
+		// the checksum is cleared first, so that it never belongs to another avatar
+		metadata := readMetadata(key)
+		hasChecksum := metadata.Checksum != ""
+		if hasChecksum {
+			metadata.Checksum = ""
+			if err := writeMetadata(key, metadata); err != nil {
+				return err
+			}
+		}
+		if err := writeToStorage(key, master); err != nil {
+			return err
+		}
+		if hasChecksum {
+			metadata.Checksum = checksum(master.data)
+			if err := writeMetadata(key, metadata); err != nil {
+				return err
+			}
+		}
+		unlock := lockAvatar(name)
+		prerenderChanged(name)
+		unlock()
+		regenerated++
+	}
+	log.Printf("Regenerated %d avatars, skipped %d avatars without (valid) original", regenerated, skipped)
+	return nil
+}
+
+func historyCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	versions, err := getVersions(resolveHash(args[0]))
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		fmt.Printf("%s  replaced %s  uploaded %s by %s\n", version.ID, version.Replaced.Format(time.RFC3339),
+			version.Metadata.Uploaded.Format(time.RFC3339), version.Metadata.Email)
+	}
+	return nil
+}
+
+func revertCommand(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return revertAvatar(resolveHash(args[0]), args[1])
+}
+
+func pruneCommand(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return pruneHistory()
+}
+
+func infoCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	hash := resolveHash(args[0])
+	keys := []string{}
+	if keyExists(createAvatarPath(hash)) {
+		keys = append(keys, createAvatarPath(hash))
+	}
+	unconfirmed, err := listShardedKeys(getUnconfirmedDir())
+	if err != nil {
+		return err
+	}
+	for _, key := range unconfirmed {
+		if name := path.Base(key); !strings.Contains(name, ".") && strings.HasSuffix(name, "-"+hash) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no avatar found for %s", args[0])
+	}
+	for _, key := range keys {
+		data, err := json.MarshalIndent(readMetadata(key), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s:\n%s\n", key, data)
+	}
+	return nil
+}
+
+// Creates the metadata of avatars that were stored before metadata was kept. The time the data was last written
+// to the storage is used as upload time, this is the only time storage attributes are used.
+func metadataCommand(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	names, err := listAvatars()
+	if err != nil {
+		return err
+	}
+	created := 0
+	for _, name := range names {
+		key := createAvatarPath(name)
+		if keyExists(createMetadataPath(key)) {
+			continue
+		}
+		data, modTime, err := storage.Read(key)
+		if err != nil {
+			return err
+		}
+		metadata := Metadata{Rating: defaultRating, Uploaded: modTime.UTC(), Checksum: checksum(data)}
+		if original, err := readKey(key + originalSuffix); err == nil {
+			data = original
+		}
+		if config, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			metadata.Format, metadata.Width, metadata.Height = format, config.Width, config.Height
+		}
+		if err := writeMetadata(key, metadata); err != nil {
+			return err
+		}
+		created++
+	}
+	log.Printf("Created metadata for %d avatars", created)
+	return nil
+}
+
+func migrateCommand(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return migrateLayout()
+}
@@ -2,21 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Request parameters for a gravatar request
 type Request struct {
-	hash   string
-	size   int
-	dflt   string
-	format string
+	hash         string
+	size         int
+	dflt         string
+	format       string
+	forceDefault bool
+	rating       string
 }
 
 const (
@@ -25,92 +33,230 @@ const (
 
 var extensionRegExp = regexp.MustCompile("\\.([0-9a-zA-Z]+)$")
 
-func readFromFile(filename string, request Request) *Avatar {
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Printf("Error reading file: %v", err)
-		return nil
+// Scales the image data for the request, returning nil if the image can not be scaled. The only errors are errBusy
+// and the error of the context.
+func createAvatar(ctx context.Context, data []byte, modTime time.Time, request Request) (*Avatar, error) {
+	avatar := &Avatar{size: -1, data: data}
+	err := imageWork.run(ctx, func() error { return scale(avatar, request.size, request.format) })
+	if err == errBusy || (err != nil && err == ctx.Err()) {
+		return nil, err
 	}
-	defer file.Close()
-	avatar := readImage(file)
-	err = scale(avatar, request.size, request.format)
 	if err != nil {
 		log.Printf("Could not scale image: %v", err)
-		return nil // don't return the image, if we can't scale it it is probably corrupt
+		return nil, nil // don't return the image, if we can't scale it it is probably corrupt
 	}
 
 	avatar.cacheControl = "max-age=300"
-	if info, e := os.Stat(filename); e == nil {
-		timestamp := info.ModTime().UTC()
-		avatar.lastModified = timestamp.Format(http.TimeFormat)
-	} else {
-		avatar.lastModified = "Sat, 1 Jan 2000 12:00:00 GMT"
+	avatar.lastModified = formatLastModified(modTime)
+	avatar.etag = createETag(checksum(data), request)
+	return avatar, nil
+}
+
+func formatLastModified(modTime time.Time) string {
+	if modTime.IsZero() {
+		return "Sat, 01 Jan 2000 12:00:00 GMT"
 	}
-	return avatar
+	return modTime.UTC().Format(http.TimeFormat)
+}
+
+// Reads a local file, like the default image
+func readFromFile(ctx context.Context, filename string, request Request) (*Avatar, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Printf("Error reading file: %v", err)
+		return nil, nil
+	}
+	// the modification time of the file is not used, it is not preserved by all installation methods
+	return createAvatar(ctx, data, time.Time{}, request)
+}
+
+// Reads an avatar from the storage, the metadata provides the modification time
+func readFromStorage(ctx context.Context, key string, metadata Metadata, request Request) (*Avatar, error) {
+	data := readAvatarData(key)
+	if data == nil {
+		return nil, nil
+	}
+	return createAvatar(ctx, data, metadata.modified(), request)
+}
+
+// Reads the data of the avatar, returns nil if it doesn't exist or can't be read
+func readAvatarData(key string) []byte {
+	data, _, err := storage.Read(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", key, err)
+		}
+		return nil
+	}
+	return data
 }
 
-func retrieveFromLocal(request Request) *Avatar {
-	return readFromFile(createAvatarPath(request.hash), request)
+// Returns the key and metadata of the local avatar for the request, with the format of the request defaulting to the
+// format of the uploaded image. Returns false if the avatar is rated above the requested rating.
+func resolveLocal(request Request) (string, Metadata, Request, bool) {
+	filename := createAvatarPath(resolveHash(request.hash))
+	metadata := readMetadata(filename)
+	if ratingLevel(metadata.Rating) > ratingLevel(request.rating) {
+		log.Printf("Avatar rated %s exceeds requested rating %s", metadata.Rating, request.rating)
+		return "", metadata, request, false
+	}
+	if request.format == "" {
+		// the master is stored as png, by default the format of the uploaded image is used
+		request.format = metadata.Format
+	}
+	if *prerenderSnap {
+		request.size = nearestPrerenderedSize(request.size)
+	}
+	return filename, metadata, request, true
+}
+
+func retrieveFromLocal(ctx context.Context, request Request) (*Avatar, error) {
+	filename, metadata, request, ok := resolveLocal(request)
+	if !ok {
+		return nil, nil
+	}
+	var data []byte
+	source := metadata.Checksum
+	if source == "" {
+		// avatars stored by older versions may have no checksum
+		if data = readAvatarData(filename); data == nil {
+			return nil, nil
+		}
+		source = checksum(data)
+	}
+	key := renditionKey{hash: path.Base(filename), size: request.size, format: request.format}
+	avatar, generation := renditions.get(key, source)
+	if avatar != nil {
+		return avatar, nil
+	}
+	if avatar = readPrerendered(key.hash, metadata, request); avatar != nil {
+		renditions.add(key, source, avatar, generation)
+		return avatar, nil
+	}
+	if data == nil {
+		if data = readAvatarData(filename); data == nil {
+			return nil, nil
+		}
+	}
+	avatar, err := createAvatar(ctx, data, metadata.modified(), request)
+	// while another process replaces the avatar, the metadata may already be written but the avatar not yet
+	if avatar != nil && checksum(data) == source {
+		renditions.add(key, source, avatar, generation)
+	}
+	return avatar, err
 }
 
 // Retrieves the avatar from the remote service, returning nil if there is no avatar or it could not be retrieved
-// dflt is used instead of request.dflt
-func retrieveFromRemoteURL(remoteURL string, request Request, dflt string) *Avatar {
+// within the timeout. dflt is used instead of request.dflt
+func retrieveFromRemoteURL(ctx context.Context, remoteURL string, timeout time.Duration, request Request, dflt string) *Avatar {
 	options := fmt.Sprintf("s=%d", request.size)
 	if dflt != "" {
-		options += "&d=" + dflt
+		options += "&d=" + url.QueryEscape(dflt)
+	}
+	if request.rating != "" {
+		options += "&r=" + request.rating
 	}
 	formatPart := ""
 	if request.format != "" {
 		formatPart = "." + request.format
 	}
 	remote := remoteURL + "/" + request.hash + formatPart + "?" + options
-	log.Printf("Retrieving from: %s", remote)
-	resp, err2 := http.Get(remote)
-	if err2 != nil {
-		log.Printf("Remote lookup of %s failed with error: %s", remote, err2)
-		return nil
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 404 {
-		log.Printf("Avatar not found on remote %s", remoteURL)
-		return nil
+	avatar := fetchRemote(ctx, remote)
+	if avatar != nil {
+		avatar.size = request.size // assume image is scaled by remote service
+		avatar.etag = createETag(checksum(avatar.data), request)
 	}
-	avatar := readImage(resp.Body)
-	avatar.size = request.size // assume image is scaled by remote service
-	avatar.lastModified = resp.Header.Get("Last-Modified")
-
-	// We don't use the cache control from the remote, it may be set to a very long time if the image can not change
-	// from request to request (like with unicornify).
-	// NOTE: This violates the cache contract because the image may be requested again from the remote
-	// server before the cache expires. To solve this properly we would need to cache the responses ourselves.
-	//	avatar.cacheControl = resp.Header.Get("Cache-Control")
-	avatar.cacheControl = "max-age=300"
-
 	return avatar
 }
 
-// Retrieves the avatar from the remote services, returning nil if there is no avatar or it could not be retrieved
-func retrieveFromRemote(request Request) *Avatar {
-	l := len(remoteUrls)
-	if l == 0 {
-		return nil
+// Returns the timeout for the remote service with the index in remoteUrls, the last configured timeout applies to
+// the remaining services
+func getRemoteTimeout(idx int) time.Duration {
+	if len(remoteTimeouts) == 0 {
+		return defaultRemoteTimeout
 	}
-	for _, remoteURL := range remoteUrls[:l-1] {
-		if avatar := retrieveFromRemoteURL(remoteURL, request, d404); avatar != nil {
+	if idx >= len(remoteTimeouts) {
+		idx = len(remoteTimeouts) - 1
+	}
+	return remoteTimeouts[idx]
+}
+
+// Runs the lookups concurrently and returns the first avatar in the order of the lookups. The lookups after that one
+// are cancelled.
+func retrieveFromFirst(ctx context.Context, lookups []func(ctx context.Context) *Avatar) *Avatar {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]chan *Avatar, len(lookups))
+	for idx, lookup := range lookups {
+		results[idx] = make(chan *Avatar, 1)
+		go func(lookup func(ctx context.Context) *Avatar, result chan<- *Avatar) {
+			result <- lookup(ctx)
+		}(lookup, results[idx])
+	}
+	for _, result := range results {
+		if avatar := <-result; avatar != nil {
 			return avatar
 		}
 	}
+	return nil
+}
+
+// Retrieves the avatar from the remote services, returning nil if there is no avatar or it could not be retrieved.
+// The federated service and all but the last remote service are queried concurrently, the last remote service
+// provides the default and is only queried if none of the others has the avatar.
+func retrieveFromRemote(ctx context.Context, request Request) *Avatar {
+	var lookups []func(ctx context.Context) *Avatar
+	if *federation {
+		lookups = append(lookups, func(ctx context.Context) *Avatar {
+			if email := lookupEmail(request.hash); email != "" {
+				if federatedURL := lookupFederatedURL(ctx, email); federatedURL != "" {
+					return retrieveFromRemoteURL(ctx, federatedURL, federationTimeout, request, d404)
+				}
+			}
+			return nil
+		})
+	}
+	l := len(remoteUrls)
+	for idx := 0; idx < l-1; idx++ {
+		remoteURL, timeout := remoteUrls[idx], getRemoteTimeout(idx)
+		lookups = append(lookups, func(ctx context.Context) *Avatar {
+			return retrieveFromRemoteURL(ctx, remoteURL, timeout, request, d404)
+		})
+	}
+	if avatar := retrieveFromFirst(ctx, lookups); avatar != nil || l == 0 {
+		return avatar
+	}
 	dflt := remoteDefault
 	if request.dflt != "" {
 		dflt = request.dflt
 	}
-	return retrieveFromRemoteURL(remoteUrls[l-1], request, dflt)
+	if isURLDefault(dflt) {
+		// we redirect to the default ourselves if the remote doesn't have the avatar
+		dflt = d404
+	}
+	return retrieveFromRemoteURL(ctx, remoteUrls[l-1], getRemoteTimeout(l-1), request, dflt)
 }
 
-func writeAvatarResult(w http.ResponseWriter, avatar *Avatar) {
+// Writes the avatar with its header fields, the body is omitted for HEAD requests. The avatar is selected by the URL
+// only, there is no content negotiation that would require a Vary header.
+func writeAvatarResult(w http.ResponseWriter, r *http.Request, avatar *Avatar) {
+	setHeaderField(w, "ETag", avatar.etag)
 	setHeaderField(w, "Last-Modified", avatar.lastModified)
 	setHeaderField(w, "Cache-Control", avatar.cacheControl)
+	if notModified(r, avatar.etag, avatar.lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	setHeaderField(w, "Content-Type", avatar.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(avatar.data)))
+	if r.Method == "HEAD" {
+		return
+	}
 	b := bytes.NewBuffer(avatar.data)
 	_, err := io.Copy(w, b)
 	if err != nil {
@@ -118,62 +264,161 @@ func writeAvatarResult(w http.ResponseWriter, avatar *Avatar) {
 	}
 }
 
-func retrieveImage(request Request, w http.ResponseWriter, r *http.Request) *Avatar {
-	avatar := retrieveFromLocal(request)
+// Generates the builtin default image, either requested or configured. Returns nil if the default is not builtin.
+// The only error is errBusy.
+func generateDefault(ctx context.Context, request Request) (*Avatar, error) {
+	dflt := request.dflt
+	if dflt == "" {
+		dflt = remoteDefault
+	}
+	if dflt == dMysteryPerson || mysteryPersonAliases[dflt] {
+		return readFromFile(ctx, "resources/mm", request)
+	}
+	if _, ok := generators[dflt]; !ok {
+		return nil, nil
+	}
+	format := request.format
+	if format == "" {
+		format = "png"
+	}
+	avatar := &Avatar{size: request.size, cacheControl: "max-age=300"}
+	err := imageWork.run(ctx, func() error {
+		if img := generateImage(dflt, request.hash, request.size); img != nil {
+			image2Avatar(avatar, img, format)
+		}
+		return nil
+	})
+	if err != nil || avatar.data == nil {
+		return nil, err
+	}
+	avatar.etag = createETag(checksum(avatar.data), request)
+	return avatar, nil
+}
+
+// Retrieves the avatar, or the default image if there is no avatar. Returns nil if no image should be
+// returned, which is the case for the 404 default and for URL defaults (the client should be redirected).
+// Returns errBusy if the image can not be scaled because there is too much work.
+func retrieveImage(ctx context.Context, request Request) (*Avatar, error) {
+	var avatar *Avatar
+	var err error
+	if !request.forceDefault {
+		if avatar, err = retrieveFromLocal(ctx, request); err != nil {
+			return nil, err
+		}
+	}
+	if avatar == nil && !request.forceDefault {
+		avatar = retrieveFromRemote(ctx, request)
+	}
+	if avatar == nil && isURLDefault(request.dflt) {
+		return nil, nil
+	}
 	if avatar == nil {
-		avatar = retrieveFromRemote(request)
+		avatar, err = generateDefault(ctx, request)
 	}
-	if avatar == nil && request.dflt != d404 {
-		avatar = readFromFile(defaultImage, request)
+	if avatar == nil && err == nil && request.dflt != d404 {
+		avatar, err = readFromFile(ctx, defaultImage, request)
 	}
-	if avatar == nil && request.dflt != d404 {
-		avatar = readFromFile("resources/mm", request)
+	if avatar == nil && err == nil && request.dflt != d404 {
+		avatar, err = readFromFile(ctx, "resources/mm", request)
 	}
-	return avatar
+	return avatar, err
 }
 
 func loadImage(request Request, w http.ResponseWriter, r *http.Request) {
 	log.Printf("Loading image: %v", request)
-	avatar := retrieveImage(request, w, r)
-	if avatar == nil {
+	if (isConditional(r) || r.Method == "HEAD") && !request.forceDefault {
+		// revalidations of local avatars are answered without scaling, as are HEAD requests for renditions that are
+		// cached or pre-rendered. Other HEAD requests are handled like GET requests, since the length of the avatar
+		// is only known after scaling.
+		if avatar := peekLocal(request); avatar != nil && (avatar.data != nil || notModified(r, avatar.etag, avatar.lastModified)) {
+			writeAvatarResult(w, r, avatar)
+			return
+		}
+	}
+	// concurrent identical requests share the result
+	avatar, err := inflight.do(r.Context(), request, func(ctx context.Context) (*Avatar, error) {
+		return retrieveImage(ctx, request)
+	})
+	if err == errBusy {
+		writeBusy(w)
+	} else if avatar == nil && isURLDefault(request.dflt) {
+		http.Redirect(w, r, request.dflt, http.StatusFound)
+	} else if avatar == nil {
 		http.NotFound(w, r)
 	} else {
-		writeAvatarResult(w, avatar)
+		writeAvatarResult(w, r, avatar)
 	}
 }
 
+func isURLDefault(dflt string) bool {
+	return strings.HasPrefix(dflt, "http://") || strings.HasPrefix(dflt, "https://")
+}
+
 // checks if dflt is a valid default image and only then returns it
 // otherwise an empty string is returned
 func validDefault(dflt string) string {
-	if dflt == d404 {
+	if isURLDefault(dflt) {
+		if u, err := url.ParseRequestURI(dflt); err == nil && u.Host != "" {
+			return dflt
+		}
+		return ""
+	}
+	dflt = strings.ToLower(dflt)
+	if dflt == d404 || isBuiltinDefault(dflt) {
 		return dflt
 	}
 	return ""
 }
 
+// returns the value of the first of the given (alias) parameters that is not empty
+func formValue(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.FormValue(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
 func avatarHandler(w http.ResponseWriter, r *http.Request, hash string) {
 	r.ParseForm()
-	sizeParam := r.FormValue("s")
+	sizeParam := formValue(r, "s", "size")
 	size := 80
 	if sizeParam != "" {
-		if s, err := strconv.Atoi(sizeParam); err == nil {
-			size = max(min(s, maxSize), minSize)
+		s, err := strconv.Atoi(sizeParam)
+		if err != nil || s <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid size '%s'", sizeParam), http.StatusBadRequest)
+			return
 		}
+		size = max(min(s, *maxSize), minSize)
+	}
+	dflt := validDefault(formValue(r, "d", "default"))
+	forceDefault := strings.ToLower(formValue(r, "f", "forcedefault")) == "y"
+	rating := validRating(formValue(r, "r", "rating"))
+	if rating == "" {
+		rating = defaultRating
 	}
-	dflt := validDefault(r.FormValue("d"))
 
 	format := ""
 	m := extensionRegExp.FindStringSubmatch(r.URL.Path)
 	if m != nil {
 		format = normalizeFormat(m[1])
 	}
+	if _, ok := profileFormats[format]; ok {
+		serveProfile(w, r, hash, format)
+		return
+	}
+	if format != "" && !avatarFormats[format] {
+		http.Error(w, fmt.Sprintf("Invalid format '%s'", m[1]), http.StatusBadRequest)
+		return
+	}
 
-	loadImage(Request{hash: hash, size: size, dflt: dflt, format: format}, w, r)
+	loadImage(Request{hash: hash, size: size, dflt: dflt, format: format, forceDefault: forceDefault, rating: rating}, w, r)
 }
 
 func normalizeFormat(inputName string) string {
 	var normalizedFormat string
-	switch inputName {
+	switch inputName = strings.ToLower(inputName); inputName {
 	case "jpg":
 		normalizedFormat = "jpeg"
 	default:
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// creates a data dir with a single (red) avatar for the returned hash
+func setupDataDir(t *testing.T) (hash string, cleanup func()) {
+	cleanup = useTempStorage(t)
+	remoteUrls = []string{}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	b := new(bytes.Buffer)
+	png.Encode(b, img)
+	hash = createHash("someone@example.com")
+	if err := writeToStorage(createAvatarPath(hash), &Avatar{data: b.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	return hash, cleanup
+}
+
+func requestAvatar(path string) *httptest.ResponseRecorder {
+	handler := makeHandler(avatarHandler, "^/avatar/([a-zA-Z0-9]+)(\\.[a-zA-Z0-9]+)?$")
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) image.Image {
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	img, _, err := image.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func isRed(img image.Image) bool {
+	r, g, b, _ := img.At(img.Bounds().Dx()/2, img.Bounds().Dy()/2).RGBA()
+	return r > 0xf000 && g < 0x1000 && b < 0x1000
+}
+
+func TestLongFormParameters(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	img := decodeResponse(t, requestAvatar("/avatar/"+hash+"?size=32"))
+	if img.Bounds().Dx() != 32 || !isRed(img) {
+		t.Errorf("Expected red avatar of size 32, got size %d", img.Bounds().Dx())
+	}
+
+	w := requestAvatar("/avatar/" + createHash("unknown@example.com") + "?default=404")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown avatar, got %d", w.Code)
+	}
+}
+
+func TestForceDefault(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	for _, query := range []string{"?f=y&d=retro", "?forcedefault=y&default=retro"} {
+		img := decodeResponse(t, requestAvatar("/avatar/"+hash+query))
+		if isRed(img) {
+			t.Errorf("Expected the default image for %s, got the avatar", query)
+		}
+	}
+	w := requestAvatar("/avatar/" + hash + "?f=y&d=404")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for forced 404 default, got %d", w.Code)
+	}
+}
+
+func TestRatingFilter(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	if err := writeMetadata(createAvatarPath(hash), Metadata{Rating: "pg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for query, expectAvatar := range map[string]bool{"?d=404": false, "?d=404&r=g": false, "?d=404&r=pg": true, "?d=404&rating=x": true} {
+		w := requestAvatar("/avatar/" + hash + query)
+		if expectAvatar && w.Code != http.StatusOK {
+			t.Errorf("Expected avatar for %s, got status %d", query, w.Code)
+		}
+		if !expectAvatar && w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got status %d", query, w.Code)
+		}
+	}
+}
+
+// remote service that returns the avatar after the delay, or blocks until the request is cancelled
+func delayedRemote(avatar *Avatar, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.Write(avatar.data)
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func TestRemotePriority(t *testing.T) {
+	defer func() { remoteUrls = []string{} }()
+	first, second, last := createPortrait(16, 16), createPortrait(32, 32), createPortrait(48, 48)
+	servers := []*httptest.Server{delayedRemote(first, 100*time.Millisecond), delayedRemote(second, 0), delayedRemote(last, 0)}
+	remoteUrls = []string{}
+	for _, server := range servers {
+		defer server.Close()
+		remoteUrls = append(remoteUrls, server.URL)
+	}
+
+	avatar := retrieveFromRemote(context.Background(), Request{hash: "hash", size: 80})
+	if avatar == nil || !bytes.Equal(avatar.data, first.data) {
+		t.Errorf("Expected the avatar of the first remote")
+	}
+}
+
+func TestRemoteTimeout(t *testing.T) {
+	defer func() { remoteUrls, remoteTimeouts = []string{}, []time.Duration{} }()
+	hanging, last := delayedRemote(createPortrait(16, 16), time.Hour), createPortrait(32, 32)
+	defer hanging.Close()
+	server := delayedRemote(last, 0)
+	defer server.Close()
+	remoteUrls = []string{hanging.URL, server.URL}
+	remoteTimeouts = []time.Duration{50 * time.Millisecond, time.Second}
+
+	start := time.Now()
+	avatar := retrieveFromRemote(context.Background(), Request{hash: "hash", size: 80})
+	if avatar == nil || !bytes.Equal(avatar.data, last.data) {
+		t.Errorf("Expected the avatar of the last remote")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hanging remote to time out, took %v", elapsed)
+	}
+
+	// a cancelled request is not sent to the remote services
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if avatar := retrieveFromRemote(ctx, Request{hash: "hash", size: 80}); avatar != nil {
+		t.Errorf("Expected no avatar for a cancelled request")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	for path, contentType := range map[string]string{
+		"/avatar/" + hash:          "image/png",
+		"/avatar/" + hash + ".jpg": "image/jpeg",
+		"/avatar/" + hash + ".JPG": "image/jpeg",
+		"/avatar/" + createHash("unknown@example.com") + "?d=retro":  "image/png",
+		"/avatar/" + createHash("unknown@example.com") + ".gif?d=mm": "image/gif",
+	} {
+		w := requestAvatar(path)
+		if actual := w.Header().Get("Content-Type"); actual != contentType {
+			t.Errorf("Expected content type %s for %s, got %s", contentType, path, actual)
+		}
+		if length := w.Header().Get("Content-Length"); length != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("Expected content length %d for %s, got %s", w.Body.Len(), path, length)
+		}
+	}
+}
+
+func requestHead(path string) *httptest.ResponseRecorder {
+	handler := makeHandler(avatarHandler, "^/avatar/([a-zA-Z0-9]+)(\\.[a-zA-Z0-9]+)?$")
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("HEAD", path, nil))
+	return w
+}
+
+// verifies that the HEAD request is answered with the header fields of the GET request
+func verifyHead(t *testing.T, path string) {
+	head, get := requestHead(path), requestAvatar(path)
+	if head.Code != get.Code || head.Body.Len() != 0 {
+		t.Errorf("Unexpected HEAD response %d for %s, expected %d without body", head.Code, path, get.Code)
+	}
+	for _, field := range []string{"Content-Type", "Content-Length", "ETag"} {
+		if head.Header().Get(field) != get.Header().Get(field) {
+			t.Errorf("Expected %s %q in HEAD response for %s, got %q", field, get.Header().Get(field), path,
+				head.Header().Get(field))
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer usePrerenderSizes(32)()
+	key := createAvatarPath(hash)
+	if err := writeAvatar(key, nil, createPortrait(64, 64), Metadata{Rating: "g", Format: "jpeg"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prerender(hash); err != nil {
+		t.Fatal(err)
+	}
+	verifyHead(t, "/avatar/"+hash)
+
+	// pre-rendered sizes are answered without reading the (now corrupt) avatar, other sizes like the GET request
+	if err := storage.Write(key, []byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if w := requestHead("/avatar/" + hash + "?s=32"); w.Code != http.StatusOK || w.Header().Get("Content-Length") == "" {
+		t.Errorf("Expected pre-rendered size with Content-Length, got %d with headers %v", w.Code, w.Header())
+	}
+	verifyHead(t, "/avatar/"+hash+"?s=32")
+	verifyHead(t, "/avatar/"+hash+"?s=48")
+}
+
+func TestInvalidSize(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	for _, size := range []string{"abc", "-1", "0", "12px"} {
+		if w := requestAvatar("/avatar/" + hash + "?s=" + size); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for size %s, got %d", size, w.Code)
+		}
+	}
+	if img := decodeResponse(t, requestAvatar("/avatar/"+hash+"?s=100000")); img.Bounds().Dx() != *maxSize {
+		t.Errorf("Expected large size to be limited to %d, got %d", *maxSize, img.Bounds().Dx())
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	for _, format := range []string{"bmp", "webp", "exe"} {
+		if w := requestAvatar("/avatar/" + hash + "." + format); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for format %s, got %d", format, w.Code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Each rendition has a strong ETag derived from the checksum of the image it is rendered from and the rendering
+// parameters. Revalidations of local avatars are answered from the metadata, without reading or scaling the avatar.
+
+func createETag(sourceChecksum string, request Request) string {
+	return fmt.Sprintf("\"%s\"", checksum([]byte(fmt.Sprintf("%s/%d/%s", sourceChecksum, request.size, request.format)))[:32])
+}
+
+func isConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// Returns whether the client has the current rendition, according to the If-None-Match header of the request or, if
+// absent, the If-Modified-Since header
+func notModified(r *http.Request, etag string, lastModified string) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if noneMatch := strings.Join(r.Header.Values("If-None-Match"), ","); noneMatch != "" {
+		for _, candidate := range strings.Split(noneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// weak comparison, as specified for If-None-Match
+			if etag != "" && (candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	modifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	return err == nil && !modified.After(modifiedSince)
+}
+
+// Returns the rendition of the local avatar for the request, or nil if there is no local avatar. Unless the rendition
+// is cached or pre-rendered, it has no data but only the header fields. Those are enough to answer revalidations, but
+// not to know the length or even whether the avatar can be decoded at all. The avatar is only read if its metadata has
+// no checksum or format.
+func peekLocal(request Request) *Avatar {
+	key, metadata, request, ok := resolveLocal(request)
+	if !ok {
+		return nil
+	}
+	sum, format := metadata.Checksum, request.format
+	if sum == "" || format == "" {
+		data, _, err := storage.Read(key)
+		if err != nil {
+			return nil
+		}
+		sum = checksum(data)
+		if format == "" {
+			format = contentTypeFormat(http.DetectContentType(data))
+		}
+	}
+	hash := path.Base(key)
+	if avatar := renditions.peek(renditionKey{hash: hash, size: request.size, format: request.format}, sum); avatar != nil {
+		return avatar
+	}
+	if avatar := readPrerendered(hash, metadata, request); avatar != nil {
+		return avatar
+	}
+	return &Avatar{size: request.size, format: format, etag: createETag(sum, request),
+		lastModified: formatLastModified(metadata.modified()), cacheControl: "max-age=300"}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func requestConditional(path string, header string, value string) *httptest.ResponseRecorder {
+	handler := makeHandler(avatarHandler, "^/avatar/([a-zA-Z0-9]+)(\\.[a-zA-Z0-9]+)?$")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set(header, value)
+	handler(w, r)
+	return w
+}
+
+func TestETag(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	w := requestAvatar("/avatar/" + hash + "?s=32")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected avatar with ETag, got status %d and ETag '%s'", w.Code, etag)
+	}
+	if other := requestAvatar("/avatar/" + hash + "?s=64").Header().Get("ETag"); other == etag {
+		t.Errorf("Expected different ETag for different size")
+	}
+
+	w = requestConditional("/avatar/"+hash+"?s=32", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Errorf("Expected 304 with ETag and without body, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if w = requestConditional("/avatar/"+hash+"?s=64", "If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for ETag of other size, got %d", w.Code)
+	}
+	w = requestConditional("/avatar/"+hash+"?s=32", "If-Modified-Since", w.Header().Get("Last-Modified"))
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since, got %d", w.Code)
+	}
+}
+
+func TestETagWithoutScaling(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	key := createAvatarPath(hash)
+	if err := writeAvatar(key, nil, createPortrait(64, 64), Metadata{Rating: "g", Format: "jpeg"}); err != nil {
+		t.Fatal(err)
+	}
+	etag := requestAvatar("/avatar/" + hash).Header().Get("ETag")
+
+	// the revalidation is answered from the metadata, the (now corrupt) avatar is not decoded
+	if err := storage.Write(key, []byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if w := requestConditional("/avatar/"+hash, "If-None-Match", "\"other\", "+etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 without reading the avatar, got %d", w.Code)
+	}
+}
+
+func TestETagRemote(t *testing.T) {
+	_, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func() { remoteUrls = []string{} }()
+	remote := &fakeRemote{status: http.StatusOK, data: createPortrait(16, 16).data}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	remoteUrls = []string{server.URL}
+
+	path := "/avatar/" + createHash("remote@example.com")
+	header := requestAvatar(path).Header()
+	etag := header.Get("ETag")
+	if etag == "" || header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected ETag and content type for remote avatar, got %v", header)
+	}
+	if w := requestConditional(path, "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for remote avatar, got %d", w.Code)
+	}
+}
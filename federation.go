@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Looks up SRV records, implemented by net.Resolver. Can be replaced to use a specific DNS server.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+var resolver srvResolver = net.DefaultResolver
+
+const federationTimeout = 5 * time.Second
+
+// Creates a resolver that sends all queries to the given DNS server (host:port)
+func createResolver(server string) srvResolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func createEmailPath(hash string) string {
+	return createStorePath("emails", hash)
+}
+
+// Registers the email for its (MD5) hash, so that the email can be found for a hash
+func registerEmail(email string) error {
+	return writeStoreEntry("emails", createHash(email), []byte(normalizeEmail(email)))
+}
+
+// Returns the email for the hash, or an empty string if it is not known
+func lookupEmail(hash string) string {
+	data, err := readKey(createEmailPath(resolveHash(hash)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Finds the avatar service for the email domain using DNS SRV records, as specified by libravatar
+// (https://wiki.libravatar.org/api/). Returns an empty string if the domain has no avatar service, or if that service
+// is this one. Querying ourselves would only find the same missing avatar after waiting for our own request.
+func lookupFederatedURL(ctx context.Context, email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, own := range emailDomains {
+		if domain == own {
+			return ""
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, federationTimeout)
+	defer cancel()
+	for _, service := range []struct {
+		name, scheme, defaultPort string
+	}{{"avatars-sec", "https", "443"}, {"avatars", "http", "80"}} {
+		_, addrs, err := resolver.LookupSRV(ctx, service.name, "tcp", domain)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		// records are sorted by priority and randomized by weight
+		target := strings.TrimSuffix(addrs[0].Target, ".")
+		if target == "" {
+			continue
+		}
+		port := fmt.Sprintf("%d", addrs[0].Port)
+		host := target
+		if port != service.defaultPort {
+			host = net.JoinHostPort(target, port)
+		}
+		if isServiceHost(target) {
+			log.Printf("Federated avatar service for domain %s is this service", domain)
+			return ""
+		}
+		return fmt.Sprintf("%s://%s/avatar", service.scheme, host)
+	}
+	log.Printf("No federated avatar service found for domain %s", domain)
+	return ""
+}
+
+// Returns whether the host name is the host of the service url
+func isServiceHost(host string) bool {
+	serviceURL, err := url.Parse(getServiceURL())
+	return err == nil && strings.EqualFold(serviceURL.Hostname(), host)
+}
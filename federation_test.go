@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Minimal DNS server that answers SRV queries from records, and NXDOMAIN for all other names
+func startFakeDNS(t *testing.T, records map[string]*net.SRV) (addr string, stop func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := answerQuery(buf[:n], records); response != nil {
+				conn.WriteTo(response, client)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func answerQuery(query []byte, records map[string]*net.SRV) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// parse the name of the (single) question
+	var labels []string
+	offset := 12
+	for offset < len(query) && query[offset] != 0 {
+		l := int(query[offset])
+		if offset+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[offset+1:offset+1+l]))
+		offset += 1 + l
+	}
+	questionEnd := offset + 5
+	if questionEnd > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[offset+1:])
+
+	srv := records[strings.ToLower(strings.Join(labels, "."))]
+	header := make([]byte, 12)
+	copy(header, query[:2])
+	flags := uint16(0x8580)
+	ancount := uint16(0)
+	if srv == nil || qtype != 33 {
+		flags |= 3 // NXDOMAIN
+	} else {
+		ancount = 1
+	}
+	binary.BigEndian.PutUint16(header[2:], flags)
+	binary.BigEndian.PutUint16(header[4:], 1)
+	binary.BigEndian.PutUint16(header[6:], ancount)
+
+	response := append(header, query[12:questionEnd]...)
+	if ancount == 0 {
+		return response
+	}
+	target := encodeName(srv.Target)
+	rr := []byte{0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60}
+	rr = append(rr, byte((6+len(target))>>8), byte(6+len(target)))
+	rr = append(rr, 0, byte(srv.Priority), 0, byte(srv.Weight), byte(srv.Port>>8), byte(srv.Port))
+	rr = append(rr, target...)
+	return append(response, rr...)
+}
+
+func TestLookupFederatedURL(t *testing.T) {
+	addr, stop := startFakeDNS(t, map[string]*net.SRV{
+		"_avatars-sec._tcp.secure.example.com": {Target: "avatars.secure.example.com.", Port: 443},
+		"_avatars._tcp.plain.example.com":      {Target: "avatars.plain.example.com.", Port: 8080},
+	})
+	defer stop()
+	defer func(r srvResolver) { resolver = r }(resolver)
+	resolver = createResolver(addr)
+
+	expected := map[string]string{
+		"someone@secure.example.com": "https://avatars.secure.example.com/avatar",
+		"someone@plain.example.com":  "http://avatars.plain.example.com:8080/avatar",
+		"someone@other.example.com":  "",
+	}
+	for email, url := range expected {
+		if actual := lookupFederatedURL(context.Background(), email); actual != url {
+			t.Errorf("Expected %q for %s, got %q", url, email, actual)
+		}
+	}
+}
+
+func TestLookupFederatedURLSkipsOwnService(t *testing.T) {
+	addr, stop := startFakeDNS(t, map[string]*net.SRV{
+		"_avatars._tcp.own.example.com":   {Target: "avatars.example.com.", Port: 80},
+		"_avatars._tcp.alias.example.com": {Target: "Avatars.Example.com.", Port: 8080},
+	})
+	defer stop()
+	defer func(r srvResolver) { resolver = r }(resolver)
+	resolver = createResolver(addr)
+	defer func(root string, domains []string) { *webroot, emailDomains = root, domains }(*webroot, emailDomains)
+	*webroot = "https://avatars.example.com"
+	emailDomains = []string{"own.example.com"}
+
+	for _, email := range []string{"someone@own.example.com", "someone@alias.example.com"} {
+		if actual := lookupFederatedURL(context.Background(), email); actual != "" {
+			t.Errorf("Expected no federated service for %s, got %q", email, actual)
+		}
+	}
+}
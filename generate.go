@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Builtin default images, see https://en.gravatar.com/site/implement/images/
+const (
+	dMysteryPerson = "mp"
+	dIdenticon     = "identicon"
+	dMonsterID     = "monsterid"
+	dWavatar       = "wavatar"
+	dRetro         = "retro"
+	dRobohash      = "robohash"
+	dBlank         = "blank"
+)
+
+// older names of the mystery person default that are still accepted by gravatar
+var mysteryPersonAliases = map[string]bool{"mm": true, "mysteryman": true}
+
+type generator func(c *canvas, seed []byte)
+
+var generators = map[string]generator{
+	dIdenticon: drawIdenticon,
+	dMonsterID: drawMonster,
+	dWavatar:   drawWavatar,
+	dRetro:     drawRetro,
+	dRobohash:  drawRobot,
+	dBlank:     func(c *canvas, seed []byte) {},
+}
+
+func isBuiltinDefault(dflt string) bool {
+	_, ok := generators[dflt]
+	return ok || dflt == dMysteryPerson || mysteryPersonAliases[dflt]
+}
+
+// Generates the builtin default image for the hash. The image is deterministic for a given hash, so the same user
+// always gets the same image. Returns nil if dflt is not a generated default.
+func generateImage(dflt string, hash string, size int) image.Image {
+	gen, ok := generators[dflt]
+	if !ok {
+		return nil
+	}
+	seed := sha256.Sum256([]byte(hash))
+	c := &canvas{img: image.NewNRGBA(image.Rect(0, 0, size, size)), size: float64(size)}
+	gen(c, seed[:])
+	return c.img
+}
+
+// Simple canvas on which shapes are drawn using coordinates in the range [0,1]
+type canvas struct {
+	img  *image.NRGBA
+	size float64
+}
+
+// fills all pixels for which inside returns true, x and y are passed as the center of the pixel
+func (c *canvas) fill(col color.Color, x0, y0, x1, y1 float64, inside func(x, y float64) bool) {
+	minX := max(int(math.Floor(x0*c.size)), 0)
+	minY := max(int(math.Floor(y0*c.size)), 0)
+	maxX := min(int(math.Ceil(x1*c.size)), int(c.size))
+	maxY := min(int(math.Ceil(y1*c.size)), int(c.size))
+	for py := minY; py < maxY; py++ {
+		for px := minX; px < maxX; px++ {
+			x := (float64(px) + 0.5) / c.size
+			y := (float64(py) + 0.5) / c.size
+			if inside(x, y) {
+				c.img.Set(px, py, col)
+			}
+		}
+	}
+}
+
+func (c *canvas) rect(col color.Color, x0, y0, x1, y1 float64) {
+	c.fill(col, x0, y0, x1, y1, func(x, y float64) bool {
+		return x >= x0 && x < x1 && y >= y0 && y < y1
+	})
+}
+
+func (c *canvas) ellipse(col color.Color, cx, cy, rx, ry float64) {
+	c.fill(col, cx-rx, cy-ry, cx+rx, cy+ry, func(x, y float64) bool {
+		dx := (x - cx) / rx
+		dy := (y - cy) / ry
+		return dx*dx+dy*dy <= 1
+	})
+}
+
+func (c *canvas) triangle(col color.Color, ax, ay, bx, by, cx, cy float64) {
+	side := func(x, y, x0, y0, x1, y1 float64) float64 {
+		return (x-x1)*(y0-y1) - (x0-x1)*(y-y1)
+	}
+	minX := math.Min(ax, math.Min(bx, cx))
+	minY := math.Min(ay, math.Min(by, cy))
+	maxX := math.Max(ax, math.Max(bx, cx))
+	maxY := math.Max(ay, math.Max(by, cy))
+	c.fill(col, minX, minY, maxX, maxY, func(x, y float64) bool {
+		d1 := side(x, y, ax, ay, bx, by)
+		d2 := side(x, y, bx, by, cx, cy)
+		d3 := side(x, y, cx, cy, ax, ay)
+		neg := d1 < 0 || d2 < 0 || d3 < 0
+		pos := d1 > 0 || d2 > 0 || d3 > 0
+		return !(neg && pos)
+	})
+}
+
+// converts hue, saturation and lightness (all in [0,1]) to a color
+func hsl(h, s, l float64) color.NRGBA {
+	q := l + s - l*s
+	if l < 0.5 {
+		q = l * (1 + s)
+	}
+	p := 2*l - q
+	component := func(t float64) uint8 {
+		t = t - math.Floor(t)
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(math.Round(v * 255))
+	}
+	return color.NRGBA{component(h + 1.0/3), component(h), component(h - 1.0/3), 255}
+}
+
+func hue(b byte) float64 {
+	return float64(b) / 256
+}
+
+// fraction in [0,1) derived from a seed byte
+func frac(b byte) float64 {
+	return float64(b) / 256
+}
+
+var (
+	white = color.NRGBA{255, 255, 255, 255}
+	black = color.NRGBA{0, 0, 0, 255}
+)
+
+// 5x5 horizontally mirrored pixel pattern in the style of an 8-bit game character
+func drawRetro(c *canvas, seed []byte) {
+	c.rect(white, 0, 0, 1, 1)
+	fg := hsl(hue(seed[0]), 0.6, 0.5)
+	const cells = 5
+	for row := 0; row < cells; row++ {
+		for col := 0; col <= cells/2; col++ {
+			if seed[1+row*3+col]&1 == 0 {
+				continue
+			}
+			y := float64(row) / cells
+			for _, x := range []int{col, cells - 1 - col} {
+				c.rect(fg, float64(x)/cells, y, float64(x+1)/cells, y+1.0/cells)
+			}
+		}
+	}
+}
+
+// 4x4 symmetric quilt of geometric patches
+func drawIdenticon(c *canvas, seed []byte) {
+	c.rect(white, 0, 0, 1, 1)
+	fg := hsl(hue(seed[0]), 0.5+frac(seed[1])/4, 0.45)
+	const cells = 4
+	const cell = 1.0 / cells
+	for row := 0; row < cells/2; row++ {
+		for col := 0; col < cells/2; col++ {
+			b := seed[2+row*cells/2+col]
+			shape := b % 6
+			// each patch is mirrored into the four quadrants, rotating along
+			for q := 0; q < 4; q++ {
+				r, k := row, col
+				if q&1 == 1 {
+					k = cells - 1 - col
+				}
+				if q&2 == 2 {
+					r = cells - 1 - row
+				}
+				x0, y0 := float64(k)*cell, float64(r)*cell
+				x1, y1 := x0+cell, y0+cell
+				mx, my := x0+cell/2, y0+cell/2
+				switch shape {
+				case 0:
+					c.rect(fg, x0, y0, x1, y1)
+				case 1:
+					c.triangle(fg, x0, y0, x1, y0, x0, y1)
+				case 2:
+					c.triangle(fg, x1, y0, x1, y1, x0, y1)
+				case 3:
+					c.triangle(fg, mx, y0, x1, my, mx, y1)
+					c.triangle(fg, mx, y0, x0, my, mx, y1)
+				case 4:
+					c.ellipse(fg, mx, my, cell/3, cell/3)
+				case 5:
+					c.triangle(fg, x0, y0, x1, y0, mx, y1)
+				}
+			}
+		}
+	}
+}
+
+// round face with eyes and a mouth
+func drawWavatar(c *canvas, seed []byte) {
+	h := hue(seed[0])
+	c.rect(hsl(h, 0.5, 0.8), 0, 0, 1, 1)
+	c.ellipse(hsl(h+0.5, 0.6, 0.6), 0.5, 0.55, 0.4, 0.38)
+	eyeY := 0.42 + frac(seed[1])*0.08
+	eyeDist := 0.12 + frac(seed[2])*0.08
+	eyeSize := 0.06 + frac(seed[3])*0.05
+	for _, x := range []float64{0.5 - eyeDist, 0.5 + eyeDist} {
+		c.ellipse(white, x, eyeY, eyeSize, eyeSize*(1+frac(seed[4])/2))
+		c.ellipse(black, x+(frac(seed[5])-0.5)*eyeSize, eyeY, eyeSize/2, eyeSize/2)
+	}
+	mouthW := 0.1 + frac(seed[6])*0.12
+	if seed[7]&1 == 0 {
+		c.ellipse(hsl(0, 0.6, 0.3), 0.5, 0.72, mouthW, 0.04+frac(seed[8])*0.06)
+	} else {
+		c.rect(hsl(0, 0.6, 0.3), 0.5-mouthW, 0.7, 0.5+mouthW, 0.74)
+	}
+}
+
+// monster with a body, limbs, a variable number of eyes and optional horns
+func drawMonster(c *canvas, seed []byte) {
+	c.rect(white, 0, 0, 1, 1)
+	body := hsl(hue(seed[0]), 0.55, 0.5)
+	limbs := hsl(hue(seed[0]), 0.55, 0.35)
+	armY := 0.5 + frac(seed[1])*0.1
+	c.rect(limbs, 0.1, armY, 0.9, armY+0.07)
+	legX := 0.12 + frac(seed[2])*0.1
+	c.rect(limbs, 0.5-legX-0.05, 0.7, 0.5-legX+0.05, 0.95)
+	c.rect(limbs, 0.5+legX-0.05, 0.7, 0.5+legX+0.05, 0.95)
+	if seed[3]&1 == 1 {
+		c.triangle(limbs, 0.28, 0.3, 0.36, 0.3, 0.24, 0.08)
+		c.triangle(limbs, 0.64, 0.3, 0.72, 0.3, 0.76, 0.08)
+	}
+	c.ellipse(body, 0.5, 0.52, 0.28+frac(seed[4])*0.08, 0.3)
+	eyes := 1 + int(seed[5]%3)
+	eyeSize := 0.1 - float64(eyes)*0.015
+	for i := 0; i < eyes; i++ {
+		x := 0.5 + (float64(i)-float64(eyes-1)/2)*eyeSize*2.4
+		c.ellipse(white, x, 0.42, eyeSize, eyeSize)
+		c.ellipse(black, x, 0.42+frac(seed[6])*eyeSize/2, eyeSize/2, eyeSize/2)
+	}
+	teeth := 2 + int(seed[7]%4)
+	c.rect(black, 0.36, 0.6, 0.64, 0.68)
+	for i := 0; i < teeth; i++ {
+		x := 0.36 + (float64(i)+0.5)*0.28/float64(teeth)
+		c.triangle(white, x-0.03, 0.6, x+0.03, 0.6, x, 0.65)
+	}
+}
+
+// robot head with antenna, eyes and a mouth grille
+func drawRobot(c *canvas, seed []byte) {
+	c.rect(hsl(hue(seed[0])+0.5, 0.3, 0.85), 0, 0, 1, 1)
+	metal := hsl(hue(seed[0]), 0.35, 0.55)
+	dark := hsl(hue(seed[0]), 0.35, 0.3)
+	c.rect(dark, 0.48, 0.08, 0.52, 0.22)
+	c.ellipse(hsl(hue(seed[1]), 0.8, 0.5), 0.5, 0.08, 0.05, 0.05)
+	top := 0.2 + frac(seed[2])*0.05
+	width := 0.3 + frac(seed[3])*0.08
+	c.rect(metal, 0.5-width, top, 0.5+width, 0.9)
+	c.rect(dark, 0.5-width-0.06, 0.45, 0.5-width, 0.62)
+	c.rect(dark, 0.5+width, 0.45, 0.5+width+0.06, 0.62)
+	eye := hsl(hue(seed[4]), 0.9, 0.55)
+	eyeSize := 0.06 + frac(seed[5])*0.04
+	for _, x := range []float64{0.36, 0.64} {
+		if seed[6]&1 == 0 {
+			c.ellipse(eye, x, 0.42, eyeSize, eyeSize)
+		} else {
+			c.rect(eye, x-eyeSize, 0.42-eyeSize/2, x+eyeSize, 0.42+eyeSize/2)
+		}
+	}
+	c.rect(dark, 0.32, 0.64, 0.68, 0.78)
+	bars := 3 + int(seed[7]%4)
+	for i := 1; i < bars; i++ {
+		x := 0.32 + float64(i)*0.36/float64(bars)
+		c.rect(metal, x-0.01, 0.64, x+0.01, 0.78)
+	}
+}
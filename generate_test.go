@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestValidDefault(t *testing.T) {
+	valid := map[string]string{
+		"404":                         "404",
+		"Identicon":                   "identicon",
+		"mm":                          "mm",
+		"blank":                       "blank",
+		"https://example.com/img.png": "https://example.com/img.png",
+		"unicorn":                     "",
+		"http://":                     "",
+		"":                            "",
+	}
+	for dflt, expected := range valid {
+		if actual := validDefault(dflt); actual != expected {
+			t.Errorf("validDefault(%q) = %q, expected %q", dflt, actual, expected)
+		}
+	}
+}
+
+func TestGenerateImage(t *testing.T) {
+	for name := range generators {
+		t.Run(name, func(t *testing.T) {
+			img := generateImage(name, "0bc83cb571cd1c50ba6f3e8a78ef1346", 48)
+			if img == nil || img.Bounds() != image.Rect(0, 0, 48, 48) {
+				t.Fatalf("Expected 48x48 image, got %v", img)
+			}
+			same := generateImage(name, "0bc83cb571cd1c50ba6f3e8a78ef1346", 48)
+			if !sameImage(img, same) {
+				t.Errorf("Generated image is not deterministic")
+			}
+		})
+	}
+	if generateImage("404", "0bc83cb571cd1c50ba6f3e8a78ef1346", 48) != nil {
+		t.Errorf("404 should not generate an image")
+	}
+}
+
+func sameImage(a, b image.Image) bool {
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if a.At(x, y) != b.At(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
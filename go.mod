@@ -3,6 +3,8 @@ module github.com/bertbaron/intravatar
 go 1.14
 
 require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/oliamb/cutter v0.2.2
 	github.com/vharitonsky/iniflags v0.0.0-20180513140207-a33cd0b5f3de
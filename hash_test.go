@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestCreateHash(t *testing.T) {
+	email := " MyEmailAddress@example.com "
+	if hash := createHash(email); hash != "0bc83cb571cd1c50ba6f3e8a78ef1346" {
+		t.Errorf("Unexpected MD5 hash %s", hash)
+	}
+	if hash := createSha256Hash(email); hash != "84059b07d4be67b806386c0aad8070a23f18836bbaae342275dc0a83414c32ee" {
+		t.Errorf("Unexpected SHA-256 hash %s", hash)
+	}
+}
+
+func TestResolveHash(t *testing.T) {
+	cleanup := useTempStorage(t)
+	defer cleanup()
+
+	email := "someone@example.com"
+	if err := registerAliases(email); err != nil {
+		t.Fatal(err)
+	}
+	md5 := createHash(email)
+	if hash := resolveHash(createSha256Hash(email)); hash != md5 {
+		t.Errorf("SHA-256 hash resolved to %s instead of %s", hash, md5)
+	}
+	if hash := resolveHash(md5); hash != md5 {
+		t.Errorf("MD5 hash resolved to %s instead of itself", hash)
+	}
+}
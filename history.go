@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v1"
+)
+
+// Previous versions of an avatar are kept in versions/<hash>/<version>, the version being the time (in unix
+// nanoseconds) it was replaced. Owners can revert to a previous version using a link that is sent by email.
+
+// How long a link to the version history is valid
+const historyLinkValidity = 24 * time.Hour
+
+// Version of an avatar
+type Version struct {
+	ID       string    `json:"id"`
+	Replaced time.Time `json:"replaced"`
+	Metadata Metadata  `json:"metadata"`
+}
+
+// Link to the version history of an avatar that has been sent to the owner
+type historyLink struct {
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+func getVersionsDir(hash string) string {
+	return getStoreDir("versions", hash)
+}
+
+func createVersionPath(hash string, version string) string {
+	return path.Join(getVersionsDir(hash), version)
+}
+
+func createHistoryLinkPath(token string) string {
+	return createStorePath("links", token)
+}
+
+// Returns the versions of the avatar, most recent first
+func getVersions(hash string) ([]Version, error) {
+	names, err := storage.List(getVersionsDir(hash))
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	for _, name := range names {
+		if strings.Contains(name, ".") {
+			continue
+		}
+		ns, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			log.Printf("Invalid version %s of %s", name, hash)
+			continue
+		}
+		metadata := readMetadata(createVersionPath(hash, name))
+		versions = append(versions, Version{ID: name, Replaced: time.Unix(0, ns).UTC(), Metadata: metadata})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+// Keeps the current avatar (if any) as previous version
+func archiveAvatar(hash string) error {
+	current := createAvatarPath(hash)
+	if *history <= 0 || !keyExists(current) {
+		return nil
+	}
+	version := fmt.Sprintf("%d", time.Now().UnixNano())
+	log.Printf("Keeping avatar %s as version %s", hash, version)
+	if err := copyAvatar(current, createVersionPath(hash, version)); err != nil {
+		return err
+	}
+	return pruneVersions(hash)
+}
+
+// Copies the avatar together with its metadata and original
+func copyAvatar(from string, to string) error {
+	for _, suffix := range []string{metadataSuffix, originalSuffix} {
+		data, err := readKey(from + suffix)
+		if err == nil {
+			err = storage.Write(to+suffix, data)
+		} else if keyExists(from + suffix) {
+			return err
+		} else {
+			err = storage.Remove(to + suffix)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	data, err := readKey(from)
+	if err != nil {
+		return err
+	}
+	return storage.Write(to, data)
+}
+
+// Replaces the avatar of the hash by the unconfirmed avatar, keeping the current avatar as previous version
+func promoteAvatar(unconfirmed string, hash string) error {
+	defer lockAvatar(hash)()
+	if !keyExists(unconfirmed) {
+		return fmt.Errorf("%s does not exist (anymore)", unconfirmed)
+	}
+	metadata := readMetadata(unconfirmed)
+	metadata.Confirmed = time.Now().UTC()
+	if err := writeMetadata(unconfirmed, metadata); err != nil {
+		return err
+	}
+	if err := registerConfirmedEmail(metadata.Email, hash); err != nil {
+		return err
+	}
+	return replaceCurrentAvatar(hash, func(key string) error {
+		return moveAvatar(unconfirmed, key)
+	})
+}
+
+// Replaces the avatar of the hash by the avatar that write writes to key, keeping the current avatar as previous
+// version. The new avatar is pre-rendered. The avatar must be locked.
+func replaceCurrentAvatar(hash string, write func(key string) error) error {
+	if err := archiveAvatar(hash); err != nil {
+		return err
+	}
+	if err := write(createAvatarPath(hash)); err != nil {
+		return err
+	}
+	prerenderChanged(hash)
+	return nil
+}
+
+// Removes the versions that exceed the maximum number of versions or the maximum age
+func pruneVersions(hash string) error {
+	versions, err := getVersions(hash)
+	if err != nil {
+		return err
+	}
+	for idx, version := range versions {
+		tooOld := *historyMaxAge > 0 && time.Since(version.Replaced) > *historyMaxAge
+		if idx >= *history || tooOld {
+			log.Printf("Removing version %s of avatar %s", version.ID, hash)
+			if err := removeAvatar(createVersionPath(hash, version.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Makes the version the current avatar, the current avatar is kept as previous version
+func revertAvatar(hash string, version string) error {
+	versionPath := createVersionPath(hash, version)
+	if strings.Contains(version, ".") || !keyExists(versionPath) {
+		return fmt.Errorf("version %s of %s does not exist", version, hash)
+	}
+	log.Printf("Reverting avatar %s to version %s", hash, version)
+	// the version is copied first, because archiving may prune it
+	pending := path.Join("reverts", hash+"-"+version)
+	if err := copyAvatar(versionPath, pending); err != nil {
+		return err
+	}
+	return promoteAvatar(pending, hash)
+}
+
+func sendHistoryEmail(email string, token string) error {
+	log.Printf("Sending history link to %v", email)
+	url := getServiceURL() + "history/" + token
+	link := fmt.Sprintf("<a href=\"%s\">%s</a>", url, url)
+	body := "You can restore a previous version of your avatar using this link: " + link
+
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", *sender)
+	msg.SetHeader("To", email)
+	msg.SetHeader("Subject", "Restore a previous version of your avatar")
+	msg.SetBody("text/html", body)
+	return sendMessage(msg)
+}
+
+func readHistoryLink(token string) (*historyLink, error) {
+	data, err := readKey(createHistoryLinkPath(token))
+	if err != nil {
+		return nil, errors.New("Invalid link")
+	}
+	link := &historyLink{}
+	if err := json.Unmarshal(data, link); err != nil {
+		return nil, err
+	}
+	if time.Since(link.Created) > historyLinkValidity {
+		removeStoreEntry("links", token)
+		return nil, errors.New("Link expired")
+	}
+	return link, nil
+}
+
+// Removes the versions of all avatars that exceed the maximum number of versions or the maximum age, and the history
+// links that expired
+func pruneHistory() error {
+	names, err := listAvatars()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		unlock := lockAvatar(name)
+		err := pruneVersions(name)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return pruneHistoryLinks()
+}
+
+// Removes the history links that expired, links are otherwise only removed when they are used
+func pruneHistoryLinks() error {
+	keys, err := listShardedKeys("links")
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, key := range keys {
+		data, err := readKey(key)
+		if err != nil {
+			continue
+		}
+		link := &historyLink{}
+		if json.Unmarshal(data, link) != nil || time.Since(link.Created) > historyLinkValidity {
+			if err := removeStoreEntry("links", path.Base(key)); err != nil {
+				return err
+			}
+			removed++
+		}
+	}
+	log.Printf("Removed %d expired history links", removed)
+	return nil
+}
+
+// Handles the email form for requesting a history link
+func requestHistoryLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		renderTemplate(w, "history", openIDFormData())
+		return
+	}
+	email := r.FormValue("email")
+	if err := verifyEmail(email); err != nil {
+		renderSaveError(w, "Please use a valid email", err)
+		return
+	}
+	// like uploads, the link for an OpenID URL is sent to its registered owner
+	hash, _, err := resolveFormHash(email, r.FormValue("openid"))
+	if err != nil {
+		renderSaveError(w, "Please use a valid OpenID URL", err)
+		return
+	}
+	token, err := createToken()
+	if err != nil {
+		renderSaveError(w, "Failed to generate random token", err)
+		return
+	}
+	data, _ := json.Marshal(historyLink{Hash: hash, Created: time.Now()})
+	if err := writeStoreEntry("links", token, data); err != nil {
+		renderSaveError(w, "Error while creating link", err)
+		return
+	}
+	if *smtpHost == "" {
+		// like uploads, no confirmation by email is required
+		http.Redirect(w, r, "/history/"+token, http.StatusSeeOther)
+		return
+	}
+	if err := sendHistoryEmail(email, token); err != nil {
+		renderSaveError(w, "Failed to send email", err)
+		return
+	}
+	renderTemplate(w, "history", map[string]string{"Email": email})
+}
+
+// Handles /history/, /history/<token> and /history/<token>/<version>, title being the part after /history/
+func historyHandler(w http.ResponseWriter, r *http.Request, title string) {
+	if title == "" {
+		requestHistoryLink(w, r)
+		return
+	}
+	parts := strings.Split(title, "/")
+	link, err := readHistoryLink(parts[0])
+	if err != nil {
+		renderSaveError(w, "Error showing previous versions", err)
+		return
+	}
+	if len(parts) == 1 {
+		versions, err := getVersions(link.Hash)
+		if err != nil {
+			renderSaveError(w, "Error showing previous versions", err)
+			return
+		}
+		renderTemplate(w, "versions", map[string]interface{}{"Token": parts[0], "Versions": versions})
+		return
+	}
+	version := parts[1]
+	if r.Method != "POST" {
+		versionPath := createVersionPath(link.Hash, version)
+		avatar, err := readFromStorage(r.Context(), versionPath, readMetadata(versionPath), Request{size: 80, format: "png"})
+		if err == errBusy {
+			writeBusy(w)
+			return
+		}
+		if avatar == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeAvatarResult(w, r, avatar)
+		return
+	}
+	if err := revertAvatar(link.Hash, version); err != nil {
+		renderSaveError(w, "Error restoring previous version", err)
+		return
+	}
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	renderTemplate(w, "confirm", map[string]string{"Avatar": fmt.Sprintf("/avatar/%s", link.Hash), "Uniq": uniq})
+}
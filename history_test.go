@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uploads and confirms an avatar with the given rating (the rating tells the versions apart)
+func replaceAvatar(t *testing.T, hash string, rating string) {
+	data, err := readKey(createAvatarPath(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := createUnconfirmedAvatarPath(hash, "token")
+	if err := writeAvatar(pending, nil, &Avatar{data: data}, Metadata{Rating: rating}); err != nil {
+		t.Fatal(err)
+	}
+	if err := promoteAvatar(pending, hash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(n int, age time.Duration) { *history, *historyMaxAge = n, age }(*history, *historyMaxAge)
+	*history = 2
+	*historyMaxAge = 0
+
+	for _, rating := range []string{"pg", "r", "x"} {
+		replaceAvatar(t, hash, rating)
+	}
+	versions, err := getVersions(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Metadata.Rating != "r" || versions[1].Metadata.Rating != "pg" {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+
+	if err := revertAvatar(hash, versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if metadata := readMetadata(createAvatarPath(hash)); metadata.Rating != "pg" {
+		t.Errorf("Expected reverted avatar with rating pg, got %s", metadata.Rating)
+	}
+	versions, _ = getVersions(hash)
+	if len(versions) != 2 || versions[0].Metadata.Rating != "x" || versions[1].Metadata.Rating != "r" {
+		t.Errorf("Unexpected versions after revert: %v", versions)
+	}
+	if err := revertAvatar(hash, "123"); err == nil {
+		t.Error("Expected error when reverting to unknown version")
+	}
+
+	*historyMaxAge = time.Nanosecond
+	if err := pruneVersions(hash); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ = getVersions(hash); len(versions) != 0 {
+		t.Errorf("Expected all versions to be pruned, got %v", versions)
+	}
+}
+
+func TestConcurrentConfirm(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(n int) { *history = n }(*history)
+	*history = 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		token := fmt.Sprintf("token%d", i)
+		pending := createUnconfirmedAvatarPath(hash, token)
+		if err := writeAvatar(pending, nil, &Avatar{data: []byte(token)}, Metadata{Rating: "g", Token: token}); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := promoteAvatar(pending, hash); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	data, err := readKey(createAvatarPath(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata := readMetadata(createAvatarPath(hash)); string(data) != metadata.Token {
+		t.Errorf("Avatar %q does not match metadata of upload %s", data, metadata.Token)
+	}
+}
+
+func TestEmailRegisteredOnConfirmation(t *testing.T) {
+	defer useTempStorage(t)()
+	email := "someone@example.com"
+	hash := createHash(email)
+	pending := createUnconfirmedAvatarPath(hash, "token")
+	if err := writeAvatar(pending, nil, createPortrait(64, 64), Metadata{Rating: "g", Email: email}); err != nil {
+		t.Fatal(err)
+	}
+	if lookupEmail(hash) != "" || resolveHash(createSha256Hash(email)) == hash {
+		t.Fatalf("Expected the email address not to be registered before confirmation")
+	}
+	if err := promoteAvatar(pending, hash); err != nil {
+		t.Fatal(err)
+	}
+	if lookupEmail(hash) != email || resolveHash(createSha256Hash(email)) != hash {
+		t.Errorf("Expected the email address to be registered after confirmation")
+	}
+}
+
+func TestHistoryLinkForOpenID(t *testing.T) {
+	defer useTempStorage(t)()
+	defer func() { openIDHosts = []string{} }()
+	openIDHosts = []string{"id.example.com"}
+	openid := "https://id.example.com/ceo"
+	if err := openIDCommand([]string{openid, "ceo@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"email": {"ceo@example.com"}, "openid": {openid}}
+	r := httptest.NewRequest("POST", "/history/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	historyHandler(w, r, "")
+	token := strings.TrimPrefix(w.Header().Get("Location"), "/history/")
+	link, err := readHistoryLink(token)
+	if err != nil {
+		t.Fatalf("Expected history link, got %v (%s)", err, w.Body.String())
+	}
+	if link.Hash != createOpenIDHash(openid) {
+		t.Errorf("Expected history link for the OpenID URL, got %s", link.Hash)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(n int, age time.Duration) { *history, *historyMaxAge = n, age }(*history, *historyMaxAge)
+	*history = 5
+	*historyMaxAge = time.Hour
+
+	// the avatar is not replaced again after its versions expired
+	for _, replaced := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now()} {
+		version := fmt.Sprintf("%d", replaced.UnixNano())
+		if err := writeToStorage(createVersionPath(hash, version), &Avatar{data: []byte("version")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for token, created := range map[string]time.Time{"expired": time.Now().Add(-2 * historyLinkValidity), "valid": time.Now()} {
+		data, _ := json.Marshal(historyLink{Hash: hash, Created: created})
+		if err := storage.Write(createHistoryLinkPath(token), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pruneHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := getVersions(hash); err != nil || len(versions) != 1 || time.Since(versions[0].Replaced) > time.Hour {
+		t.Errorf("Expected only the expired version to be removed, got %v (%v)", versions, err)
+	}
+	if keyExists(createHistoryLinkPath("expired")) || !keyExists(createHistoryLinkPath("valid")) {
+		t.Errorf("Expected only the expired history link to be removed")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The inbox is a directory in the data dir in which images named <email>.<extension> can be dropped, for example by
+// a photo studio. They are stored as avatar of the email (without confirmation) and moved to inbox/processed, or to
+// inbox/rejected together with a file <name>.reason that tells why the image was rejected.
+
+// Interval at which the inbox is polled if inotify is not available
+const defaultInboxPoll = 10 * time.Second
+
+func getInboxDir() string {
+	return filepath.Join(*dataDir, "inbox")
+}
+
+// Watches the inbox, it only returns if the inbox can not be watched
+func watchInbox() error {
+	dir := getInboxDir()
+	for _, d := range []string{dir, filepath.Join(dir, "processed"), filepath.Join(dir, "rejected")} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return err
+		}
+	}
+	log.Printf("Watching inbox %s", dir)
+	fn := func(name string) { processInboxFile(dir, name) }
+	if *inboxPoll > 0 {
+		return pollDir(dir, *inboxPoll, fn)
+	}
+	return watchDir(dir, fn)
+}
+
+// Stores the image in the inbox as avatar and moves it to processed or rejected
+func processInboxFile(dir string, name string) {
+	filename := filepath.Join(dir, name)
+	if strings.HasPrefix(name, ".") {
+		return // hidden files are typically being written
+	}
+	if info, err := os.Stat(filename); err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	email := normalizeEmail(strings.TrimSuffix(name, filepath.Ext(name)))
+	err := errBusy
+	for err == errBusy {
+		var file *os.File
+		if file, err = os.Open(filename); err != nil {
+			break
+		}
+		err = storeAdminAvatar(email, file, defaultRating, true)
+		file.Close()
+		if err == errBusy {
+			time.Sleep(time.Second) // the inbox can wait until the image workers are available
+		}
+	}
+	if err == nil {
+		log.Printf("Stored avatar for %s from inbox", email)
+	}
+	target := filepath.Join(dir, "processed", name)
+	if err != nil {
+		log.Printf("Rejected %s in inbox: %v", name, err)
+		target = filepath.Join(dir, "rejected", name)
+		if e := ioutil.WriteFile(target+".reason", []byte(err.Error()+"\n"), 0600); e != nil {
+			log.Printf("Failed to write reason for rejecting %s: %v", name, e)
+		}
+	}
+	if err := os.Rename(filename, target); err != nil {
+		log.Printf("Failed to move %s out of the inbox: %v", name, err)
+	}
+}
+
+// Calls fn for the files in dir that did not change since the previous poll
+func pollDir(dir string, interval time.Duration, fn func(name string)) error {
+	previous := map[string]os.FileInfo{}
+	for {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		current := map[string]os.FileInfo{}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			if last, ok := previous[file.Name()]; ok && last.Size() == file.Size() && last.ModTime().Equal(file.ModTime()) {
+				fn(file.Name())
+				continue
+			}
+			current[file.Name()] = file
+		}
+		previous = current
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Calls fn for the files in dir, and for every file that is written to or moved into dir. Uses inotify, falls
+// back to polling if inotify is not available.
+func watchDir(dir string, fn func(name string)) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err == nil {
+		_, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}
+	if err != nil {
+		log.Printf("Can not watch %s with inotify (%v), polling instead", dir, err)
+		return pollDir(dir, defaultInboxPoll, fn)
+	}
+	defer syscall.Close(fd)
+
+	// files that were added before the watch was started
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			fn(file.Name())
+		}
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			if name != "" && event.Mask&syscall.IN_ISDIR == 0 {
+				fn(name)
+			}
+		}
+	}
+}
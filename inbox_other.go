@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Calls fn for the files in dir, and for every file that is written to or moved into dir. Polls the directory,
+// inotify is only available on linux.
+func watchDir(dir string, fn func(name string)) error {
+	return pollDir(dir, defaultInboxPoll, fn)
+}
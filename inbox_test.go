@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessInboxFile(t *testing.T) {
+	_, cleanup := setupDataDir(t)
+	defer cleanup()
+	dir := getInboxDir()
+	for _, d := range []string{dir, filepath.Join(dir, "processed"), filepath.Join(dir, "rejected")} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "new@example.com.jpg"), createPortrait(40, 60).data, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "broken@example.com.jpg"), []byte("not an image"), 0600)
+
+	processInboxFile(dir, "new@example.com.jpg")
+	processInboxFile(dir, "broken@example.com.jpg")
+
+	if !keyExists(createAvatarPath(createHash("new@example.com"))) {
+		t.Errorf("Expected avatar to be stored")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "processed", "new@example.com.jpg")); err != nil {
+		t.Errorf("Expected image to be moved to processed: %v", err)
+	}
+	if reason, err := ioutil.ReadFile(filepath.Join(dir, "rejected", "broken@example.com.jpg.reason")); err != nil || len(reason) == 0 {
+		t.Errorf("Expected rejected image with reason: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Expected only processed and rejected in inbox, got %d files", len(files))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Concurrent identical requests, like the avatars of the comments of a single user on a page, share the work of
+// retrieving and scaling the avatar. This also prevents bursts of requests to the remote services.
+
+type flight struct {
+	done    chan struct{}
+	avatar  *Avatar
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[Request]*flight
+	shared  int64 // requests that got the result of a flight started by another request
+}
+
+var inflight = &flightGroup{flights: map[Request]*flight{}}
+
+// Calls fn once for concurrent calls with the same request and returns its result to all of them. The context of fn
+// is cancelled when the contexts of all callers are done, a caller whose context is done gets the error of its context.
+func (g *flightGroup) do(ctx context.Context, request Request, fn func(ctx context.Context) (*Avatar, error)) (*Avatar, error) {
+	g.mutex.Lock()
+	f, ok := g.flights[request]
+	if ok {
+		g.shared++
+	} else {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[request] = f
+		go func() {
+			f.avatar, f.err = fn(fctx)
+			g.forget(request, f)
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.avatar, f.err
+	case <-ctx.Done():
+		g.mutex.Lock()
+		f.waiters--
+		abandoned := f.waiters == 0
+		if abandoned && g.flights[request] == f {
+			delete(g.flights, request) // later requests should not join the cancelled flight
+		}
+		g.mutex.Unlock()
+		if abandoned {
+			f.cancel()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) forget(request Request, f *flight) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.flights[request] == f {
+		delete(g.flights, request)
+	}
+}
+
+func (g *flightGroup) sharedRequests() int64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.shared
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{flights: map[Request]*flight{}}
+	release := make(chan struct{})
+	calls := 0
+	fn := func(ctx context.Context) (*Avatar, error) {
+		calls++
+		<-release
+		return &Avatar{size: 80}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*Avatar, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do(context.Background(), Request{hash: "hash", size: 80}, fn)
+		}(i)
+	}
+	for g.sharedRequests() < int64(len(results)-1) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Expected a single call, got %d", calls)
+	}
+	for _, result := range results {
+		if result != results[0] || result == nil {
+			t.Fatalf("Expected all requests to share the result")
+		}
+	}
+	if len(g.flights) != 0 {
+		t.Errorf("Expected finished flight to be removed")
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	g := &flightGroup{flights: map[Request]*flight{}}
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (*Avatar, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if avatar, err := g.do(ctx, Request{hash: "hash"}, fn); avatar != nil || err != context.Canceled {
+		t.Errorf("Expected no result for a cancelled request")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the work to be cancelled when all requests are gone")
+	}
+}
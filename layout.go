@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Layout versions of the stores. The version is stored under layoutKey, a store without version has the flat
+// layout.
+const (
+	// avatars/<hash>, unconfirmed/<token>-<hash>, versions/<hash>/<version> etc.
+	flatLayout = 1
+	// avatars/ab/cd/<hash>, unconfirmed/ab/cd/<token>-<hash>, versions/ab/cd/<hash>/<version> etc., sharded by the
+	// first characters of the hash (or token), so that no directory grows large and a confirmation only needs to
+	// list a single small directory
+	shardedLayout = 2
+)
+
+// Stores of entries named by a hash or token (<store>/<name> in the flat layout). The avatars and unconfirmed
+// avatars are stored with their sidecars, so they have their own path functions and migration.
+var shardedFileStores = []string{"aliases", "emails", "openids", "profiles", "links"}
+
+// Stores with a directory per hash (<store>/<hash>/<name> in the flat layout)
+var shardedDirStores = []string{"versions", "prerendered", "userimages"}
+
+const layoutKey = "layout"
+
+var layout = flatLayout
+
+// Set while a flat store is being migrated to the sharded layout. Avatars that have not been migrated yet are
+// still found at their flat path.
+var migrating int32
+
+func isMigrating() bool {
+	return atomic.LoadInt32(&migrating) != 0
+}
+
+// Reads the layout version of the storage. A new (empty) storage gets the sharded layout. If a migration was
+// interrupted, it is continued by migrateLayout.
+func initLayout() error {
+	data, err := readKey(layoutKey)
+	if os.IsNotExist(err) {
+		flat, err := hasFlatEntries()
+		if err != nil || flat {
+			layout = flatLayout
+			return err
+		}
+		return writeLayout(shardedLayout)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version < flatLayout || version > shardedLayout {
+		return fmt.Errorf("unsupported layout version '%s' in storage", strings.TrimSpace(string(data)))
+	}
+	layout = version
+	if layout == shardedLayout {
+		flat, err := hasFlatEntries()
+		if err != nil {
+			return err
+		}
+		if flat {
+			log.Printf("Storage has not been migrated completely to the sharded layout")
+			atomic.StoreInt32(&migrating, 1)
+		}
+	}
+	return nil
+}
+
+func writeLayout(version int) error {
+	layout = version
+	return storage.Write(layoutKey, []byte(strconv.Itoa(version)))
+}
+
+// Returns true if there are entries in any store with the flat layout
+func hasFlatEntries() (bool, error) {
+	for _, dir := range append([]string{"avatars", getUnconfirmedDir()}, shardedFileStores...) {
+		names, err := storage.List(dir)
+		if err != nil || len(names) > 0 {
+			return len(names) > 0, err
+		}
+	}
+	for _, dir := range shardedDirStores {
+		flat, _, err := listStoreDirs(dir)
+		if err != nil {
+			return false, err
+		}
+		// the file storage keeps directories that became empty
+		for _, d := range flat {
+			if hasKeys(d) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Returns the sharded path of the name in dir, shardKey being the (hex) string that determines the shard
+func createShardedPath(dir string, shardKey string, name string) string {
+	if len(shardKey) < 4 {
+		return path.Join(dir, name)
+	}
+	return path.Join(dir, shardKey[:2], shardKey[2:4], name)
+}
+
+// Returns the path of the entry in a store of shardedFileStores. During a migration, entries that have not been
+// migrated yet are found at their flat path.
+func createStorePath(dir string, name string) string {
+	flat := path.Join(dir, name)
+	if layout == flatLayout {
+		return flat
+	}
+	sharded := createShardedPath(dir, name, name)
+	if isMigrating() && !keyExists(sharded) && keyExists(flat) {
+		return flat
+	}
+	return sharded
+}
+
+// Entries of the stores in shardedFileStores are changed with the entry locked, so that the migration does not
+// move an entry between resolving its path and changing it. These locks are separate from the avatar locks, since
+// entries are changed while an avatar is locked.
+var storeLocks [64]sync.Mutex
+
+// Locks the entry in a store of shardedFileStores, the returned function unlocks it
+func lockStoreEntry(dir string, name string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(path.Join(dir, name)))
+	lock := &storeLocks[h.Sum32()%uint32(len(storeLocks))]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Changes the entry in a store of shardedFileStores with the entry locked, update is called with its path
+func updateStoreEntry(dir string, name string, update func(key string) error) error {
+	defer lockStoreEntry(dir, name)()
+	return update(createStorePath(dir, name))
+}
+
+func writeStoreEntry(dir string, name string, data []byte) error {
+	return updateStoreEntry(dir, name, func(key string) error {
+		return storage.Write(key, data)
+	})
+}
+
+func removeStoreEntry(dir string, name string) error {
+	return updateStoreEntry(dir, name, storage.Remove)
+}
+
+// Returns the directory of the hash in a store of shardedDirStores. During a migration, directories that have not
+// been migrated yet are found at their flat path.
+func getStoreDir(dir string, hash string) string {
+	flat := path.Join(dir, hash)
+	if layout == flatLayout {
+		return flat
+	}
+	sharded := createShardedPath(dir, hash, hash)
+	if isMigrating() && !hasKeys(sharded) && hasKeys(flat) {
+		return flat
+	}
+	return sharded
+}
+
+// Returns true if there are keys directly below dir, errors are logged and result in false
+func hasKeys(dir string) bool {
+	names, err := storage.List(dir)
+	if err != nil {
+		log.Printf("Error listing %s: %v", dir, err)
+	}
+	return len(names) > 0
+}
+
+// Returns the directory of the shard that contains the unconfirmed avatars for the token
+func getUnconfirmedShardDir(token string) string {
+	if layout == flatLayout {
+		return getUnconfirmedDir()
+	}
+	return path.Dir(createShardedPath(getUnconfirmedDir(), token, "x"))
+}
+
+// Returns the keys of all entries in a sharded store, including entries with the flat layout
+func listShardedKeys(dir string) ([]string, error) {
+	shards, err := listSubdirs([]string{dir})
+	if err == nil {
+		shards, err = listSubdirs(shards)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, d := range append([]string{dir}, shards...) {
+		names, err := storage.List(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			keys = append(keys, path.Join(d, name))
+		}
+	}
+	return keys, nil
+}
+
+// Returns the directories of the hashes in a store of shardedDirStores, including directories with the flat layout
+func listShardedDirs(dir string) ([]string, error) {
+	flat, shards, err := listStoreDirs(dir)
+	if err == nil {
+		shards, err = listSubdirs(shards)
+	}
+	if err == nil {
+		shards, err = listSubdirs(shards)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(flat, shards...), nil
+}
+
+// Returns the directories of hashes with the flat layout and the first level shards in a store of shardedDirStores.
+// They are told apart by their length, shards have two characters.
+func listStoreDirs(dir string) (flat []string, shards []string, err error) {
+	names, err := storage.ListDirs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if len(name) == 2 {
+			shards = append(shards, path.Join(dir, name))
+		} else {
+			flat = append(flat, path.Join(dir, name))
+		}
+	}
+	return flat, shards, nil
+}
+
+// Returns the directories directly below the dirs
+func listSubdirs(dirs []string) ([]string, error) {
+	var subdirs []string
+	for _, dir := range dirs {
+		names, err := storage.ListDirs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			subdirs = append(subdirs, path.Join(dir, name))
+		}
+	}
+	return subdirs, nil
+}
+
+// Migrates all stores from the flat to the sharded layout
+func migrateLayout() error {
+	if err := startLayoutMigration(); err != nil {
+		return err
+	}
+	return completeLayoutMigration()
+}
+
+// Changes the layout version to sharded, so that new avatars are stored with the sharded layout. Avatars that
+// have not been migrated yet are still found at their flat path, so the migration can be completed while the
+// service is running.
+func startLayoutMigration() error {
+	if layout != flatLayout {
+		return nil
+	}
+	atomic.StoreInt32(&migrating, 1)
+	return writeLayout(shardedLayout)
+}
+
+// Moves the entries that are still stored with the flat layout
+func completeLayoutMigration() error {
+	if !isMigrating() {
+		return nil
+	}
+	log.Printf("Migrating storage to the sharded layout")
+	avatars, err := migrateAvatars()
+	if err != nil {
+		return err
+	}
+	unconfirmed, err := migrateUnconfirmed()
+	if err != nil {
+		return err
+	}
+	others := 0
+	for _, dir := range shardedFileStores {
+		migrated, err := migrateFileStore(dir)
+		others += migrated
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range shardedDirStores {
+		migrated, err := migrateDirStore(dir)
+		others += migrated
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&migrating, 0)
+	log.Printf("Migrated %d avatars, %d unconfirmed files and %d other files to the sharded layout", avatars,
+		unconfirmed, others)
+	return nil
+}
+
+// Moves the key to its sharded path. If the sharded key exists it was written during the migration and is the
+// most recent one, so the flat key is removed.
+func migrateKey(flat string, sharded string) error {
+	if keyExists(sharded) {
+		return storage.Remove(flat)
+	}
+	return storage.Rename(flat, sharded)
+}
+
+func migrateFileStore(dir string) (int, error) {
+	names, err := storage.List(dir)
+	if err != nil {
+		return 0, err
+	}
+	for idx, name := range names {
+		unlock := lockStoreEntry(dir, name)
+		err := migrateKey(path.Join(dir, name), createShardedPath(dir, name, name))
+		unlock()
+		if err != nil {
+			return idx, err
+		}
+	}
+	return len(names), nil
+}
+
+func migrateDirStore(dir string) (int, error) {
+	flat, _, err := listStoreDirs(dir)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, hashDir := range flat {
+		hash := path.Base(hashDir)
+		names, err := storage.List(hashDir)
+		if err != nil {
+			return migrated, err
+		}
+		// the versions and renditions of an avatar are changed with the avatar locked
+		unlock := lockAvatar(hash)
+		for _, name := range names {
+			if err = migrateKey(path.Join(hashDir, name), path.Join(createShardedPath(dir, hash, hash), name)); err != nil {
+				break
+			}
+			migrated++
+		}
+		unlock()
+		if err == nil {
+			// removes the empty directory of the file storage, other storages have no directories
+			err = storage.Remove(hashDir)
+		}
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+func migrateAvatars() (int, error) {
+	names, err := storage.List("avatars")
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, name := range names {
+		if strings.Contains(name, ".") {
+			continue
+		}
+		if err := migrateAvatar(name); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	// sidecars without avatar may have been left behind by older versions
+	names, err = storage.List("avatars")
+	if err != nil {
+		return migrated, err
+	}
+	for _, name := range names {
+		hash := strings.SplitN(name, ".", 2)[0]
+		if err := storage.Rename(path.Join("avatars", name), createShardedPath("avatars", hash, name)); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+func migrateAvatar(hash string) error {
+	defer lockAvatar(hash)()
+	flat := path.Join("avatars", hash)
+	sharded := createShardedPath("avatars", hash, hash)
+	if keyExists(sharded) {
+		// the sharded avatar is the most recent one
+		return removeAvatar(flat)
+	}
+	return moveAvatar(flat, sharded)
+}
+
+func migrateUnconfirmed() (int, error) {
+	names, err := storage.List(getUnconfirmedDir())
+	if err != nil {
+		return 0, err
+	}
+	for idx, name := range names {
+		// <token>-<hash>, pending metadata and profiles have an extension
+		parts := strings.SplitN(strings.SplitN(name, ".", 2)[0], "-", 2)
+		target := createShardedPath(getUnconfirmedDir(), parts[0], name)
+		// the unconfirmed avatar may be promoted concurrently, which moves it with the avatar locked
+		unlock := lockAvatar(parts[len(parts)-1])
+		err := storage.Rename(path.Join(getUnconfirmedDir(), name), target)
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return idx, err
+		}
+	}
+	return len(names), nil
+}
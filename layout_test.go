@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLayoutMigration(t *testing.T) {
+	cleanup := useTempStorage(t)
+	defer cleanup()
+	if layout != shardedLayout {
+		t.Errorf("Expected new storage to get the sharded layout")
+	}
+
+	// simulate a data dir of an older version
+	hash := createHash("someone@example.com")
+	token := "0123456789abcdef0123456789abcdef"
+	for key, data := range map[string]string{
+		"avatars/" + hash:                             "avatar",
+		"avatars/" + hash + metadataSuffix:            `{"rating":"pg"}`,
+		"unconfirmed/" + token + "-" + hash:           "pending",
+		"unconfirmed/" + token + "-" + hash + ".json": "{}",
+		"emails/" + hash:                              "someone@example.com",
+		"versions/" + hash + "/123":                   "version",
+	} {
+		if err := storage.Write(key, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Remove(layoutKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := initLayout(); err != nil {
+		t.Fatal(err)
+	}
+	if layout != flatLayout || createAvatarPath(hash) != "avatars/"+hash {
+		t.Fatalf("Expected flat layout, got layout %d and path %s", layout, createAvatarPath(hash))
+	}
+
+	if err := startLayoutMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if createAvatarPath(hash) != "avatars/"+hash {
+		t.Errorf("Expected avatar to be found at its flat path during migration, got %s", createAvatarPath(hash))
+	}
+	if filename, _, err := getConfirmationFile(token); err != nil || filename != "unconfirmed/"+token+"-"+hash {
+		t.Errorf("Expected flat unconfirmed file during migration, got %s (%v)", filename, err)
+	}
+	if versions, _ := getVersions(hash); lookupEmail(hash) != "someone@example.com" || len(versions) != 1 {
+		t.Errorf("Expected email and version to be found at their flat path during migration")
+	}
+
+	if err := completeLayoutMigration(); err != nil {
+		t.Fatal(err)
+	}
+	sharded := "avatars/" + hash[:2] + "/" + hash[2:4] + "/" + hash
+	if createAvatarPath(hash) != sharded || !keyExists(sharded) || readMetadata(sharded).Rating != "pg" {
+		t.Errorf("Expected migrated avatar at %s, got %s", sharded, createAvatarPath(hash))
+	}
+	if filename, _, err := getConfirmationFile(token); err != nil || filename != "unconfirmed/01/23/"+token+"-"+hash {
+		t.Errorf("Expected sharded unconfirmed file after migration, got %s (%v)", filename, err)
+	}
+	if lookupEmail(hash) != "someone@example.com" || !keyExists("emails/"+hash[:2]+"/"+hash[2:4]+"/"+hash) {
+		t.Errorf("Expected migrated email at its sharded path")
+	}
+	if versions, err := getVersions(hash); err != nil || len(versions) != 1 ||
+		!keyExists("versions/"+hash[:2]+"/"+hash[2:4]+"/"+hash+"/123") {
+		t.Errorf("Expected migrated version at its sharded path, got %v (%v)", versions, err)
+	}
+	if hashes, err := listAvatars(); err != nil || !reflect.DeepEqual(hashes, []string{hash}) {
+		t.Errorf("Unexpected avatars %v (%v)", hashes, err)
+	}
+	if err := initLayout(); err != nil || layout != shardedLayout || isMigrating() {
+		t.Errorf("Expected completely migrated storage (%v)", err)
+	}
+}
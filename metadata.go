@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ratings in increasing order, see https://en.gravatar.com/site/implement/images/#rating
+var ratings = []string{"g", "pg", "r", "x"}
+
+const defaultRating = "g"
+
+// suffixes of the files that are stored next to an avatar
+const (
+	metadataSuffix = ".json"
+	originalSuffix = ".orig"
+)
+
+// Metadata stored next to an avatar
+type Metadata struct {
+	Rating string `json:"rating"`
+	// format and dimensions of the original upload
+	Format string `json:"format,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// the userimage (XML-RPC API) from which the avatar was set
+	Userimage string `json:"userimage,omitempty"`
+	// email address and IP address of the uploader, the time of the upload and the token by which it was confirmed
+	Email    string    `json:"email,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+	Token    string    `json:"token,omitempty"`
+	// the time the avatar became the current avatar
+	Confirmed time.Time `json:"confirmed"`
+	// SHA-256 of the stored avatar, from which the ETag is derived without reading it
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Returns the time the avatar was last modified, or the zero time if unknown
+func (m Metadata) modified() time.Time {
+	if !m.Confirmed.IsZero() {
+		return m.Confirmed
+	}
+	return m.Uploaded
+}
+
+// returns the index of the rating in ratings, or -1 if it is not a valid rating
+func ratingLevel(rating string) int {
+	for idx, r := range ratings {
+		if r == rating {
+			return idx
+		}
+	}
+	return -1
+}
+
+// checks if rating is a valid rating and only then returns it (normalized)
+// otherwise an empty string is returned
+func validRating(rating string) string {
+	rating = strings.ToLower(rating)
+	if ratingLevel(rating) < 0 {
+		return ""
+	}
+	return rating
+}
+
+func createMetadataPath(avatarPath string) string {
+	return avatarPath + metadataSuffix
+}
+
+// Reads the metadata of the avatar at avatarPath. Avatars without metadata (stored by older versions) get the
+// default metadata.
+func readMetadata(avatarPath string) Metadata {
+	data, err := readKey(createMetadataPath(avatarPath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading metadata: %v", err)
+		}
+		return Metadata{Rating: defaultRating}
+	}
+	return parseMetadata(avatarPath, data)
+}
+
+// Parses the metadata of the avatar at avatarPath, nil data gives the default metadata
+func parseMetadata(avatarPath string, data []byte) Metadata {
+	metadata := Metadata{Rating: defaultRating}
+	if data == nil {
+		return metadata
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		log.Printf("Invalid metadata for %s: %v", avatarPath, err)
+	}
+	if validRating(metadata.Rating) == "" {
+		metadata.Rating = defaultRating
+	}
+	return metadata
+}
+
+func writeMetadata(avatarPath string, metadata Metadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return storage.Write(createMetadataPath(avatarPath), data)
+}
+
+// Changes to the current avatar of a hash are serialized, so that concurrent uploads for the same hash never mix
+// the data and sidecars of different uploads: the upload that is confirmed last wins. Note that this only holds
+// within a single process.
+var avatarLocks [64]sync.Mutex
+
+// Locks the avatar of the hash, the returned function unlocks it
+func lockAvatar(hash string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	lock := &avatarLocks[h.Sum32()%uint32(len(avatarLocks))]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Moves the avatar together with its metadata and original. The sidecars are copied before the avatar is moved and
+// only removed afterwards, so that the move can be repeated if it is interrupted by a crash. The sidecars of the
+// destination are not touched if the avatar does not exist (anymore).
+func moveAvatar(from string, to string) error {
+	if !keyExists(from) {
+		return fmt.Errorf("%s does not exist (anymore)", from)
+	}
+	defer avatarChanged(to)
+	for _, suffix := range []string{metadataSuffix, originalSuffix} {
+		data, err := readKey(from + suffix)
+		if err == nil {
+			err = storage.Write(to+suffix, data)
+		} else if os.IsNotExist(err) {
+			err = storage.Remove(to + suffix)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := storage.Rename(from, to); err != nil {
+		return err
+	}
+	for _, suffix := range []string{metadataSuffix, originalSuffix} {
+		if err := storage.Remove(from + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the avatar together with its metadata and original
+func removeAvatar(key string) error {
+	defer avatarChanged(key)
+	for _, suffix := range []string{metadataSuffix, originalSuffix} {
+		if err := storage.Remove(key + suffix); err != nil {
+			return err
+		}
+	}
+	return storage.Remove(key)
+}
+
+// Invalidates the cached renditions if the key is (part of) a current avatar
+func avatarChanged(key string) {
+	if strings.HasPrefix(key, "avatars/") {
+		renditions.invalidate(strings.SplitN(path.Base(key), ".", 2)[0])
+	}
+}
+
+// Stores the master with its original (if any) and metadata
+func writeAvatar(key string, original *Avatar, master *Avatar, metadata Metadata) error {
+	defer avatarChanged(key)
+	if original != nil {
+		if metadata.Format == "" {
+			metadata.Format = original.format
+		}
+		if metadata.Width == 0 {
+			if config, _, err := image.DecodeConfig(bytes.NewReader(original.data)); err == nil {
+				metadata.Width, metadata.Height = config.Width, config.Height
+			}
+		}
+		if err := storage.Write(key+originalSuffix, original.data); err != nil {
+			return err
+		}
+	}
+	metadata.Checksum = checksum(master.data)
+	if err := writeMetadata(key, metadata); err != nil {
+		return err
+	}
+	return writeToStorage(key, master)
+}
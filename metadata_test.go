@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWriteAvatarMetadata(t *testing.T) {
+	cleanup := useTempStorage(t)
+	defer cleanup()
+	original := createPortrait(60, 90)
+	master, err := cropAndScale(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := createUnconfirmedAvatarPath(createHash("someone@example.com"), "token")
+	if err := writeAvatar(key, original, master, Metadata{Rating: "g", Token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	metadata := readMetadata(key)
+	if metadata.Width != 60 || metadata.Height != 90 || metadata.Format != original.format || metadata.Token != "token" {
+		t.Errorf("Unexpected metadata %v", metadata)
+	}
+}
+
+func TestLastModifiedFromMetadata(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+
+	if lastModified := requestAvatar("/avatar/" + hash).Header().Get("Last-Modified"); lastModified != "Sat, 01 Jan 2000 12:00:00 GMT" {
+		t.Errorf("Expected fixed Last-Modified without metadata, got %s", lastModified)
+	}
+	confirmed := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	metadata := Metadata{Rating: "g", Uploaded: confirmed.Add(-time.Hour), Confirmed: confirmed}
+	if err := writeMetadata(createAvatarPath(hash), metadata); err != nil {
+		t.Fatal(err)
+	}
+	if lastModified := requestAvatar("/avatar/" + hash).Header().Get("Last-Modified"); lastModified != confirmed.Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified %s, got %s", confirmed.Format(http.TimeFormat), lastModified)
+	}
+}
+
+func TestMoveMissingAvatar(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	current := createAvatarPath(hash)
+	if err := writeMetadata(current, Metadata{Rating: "pg"}); err != nil {
+		t.Fatal(err)
+	}
+	// the sidecars of an unconfirmed avatar that was moved concurrently
+	pending := createUnconfirmedAvatarPath(hash, "0123456789abcdef0123456789abcdef")
+	if err := writeMetadata(pending, Metadata{Rating: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveAvatar(pending, current); err == nil {
+		t.Errorf("Expected moving a missing avatar to fail")
+	}
+	if readMetadata(current).Rating != "pg" {
+		t.Errorf("Expected the metadata of the current avatar to be kept, got %+v", readMetadata(current))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// Uploading an avatar for an OpenID URL requires the owner of the URL to be known, only the email address that an
+// administrator registered for the URL (with the openid command) can confirm the upload. Since the owner of an OpenID
+// URL can't be derived from the URL, the email address of the uploader alone doesn't prove anything.
+
+// Normalizes an OpenID URL the way libravatar does, so that the hash matches the hash calculated by clients:
+// the scheme and host are lowercased and an empty path is replaced by '/'.
+func normalizeOpenID(openid string) (string, error) {
+	openid = strings.TrimSpace(openid)
+	if !strings.Contains(openid, "://") {
+		openid = "http://" + openid
+	}
+	u, err := url.Parse(openid)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid OpenID URL '%s'", openid)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// Creates the SHA-256 hash of the normalized OpenID URL
+func createOpenIDHash(normalizedOpenID string) string {
+	h := sha256.New()
+	io.WriteString(h, normalizedOpenID)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Verifies that avatars may be uploaded for the (normalized) OpenID URL
+func verifyOpenID(normalizedOpenID string) error {
+	if len(openIDHosts) == 0 {
+		return fmt.Errorf("uploading avatars for OpenID URLs is not enabled")
+	}
+	u, err := url.Parse(normalizedOpenID)
+	if err != nil {
+		return err
+	}
+	for _, host := range openIDHosts {
+		if u.Hostname() == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("OpenID URL is not in white list of hosts %s", openIDHosts)
+}
+
+func createOpenIDPath(hash string) string {
+	return createStorePath("openids", hash)
+}
+
+// Registers the email address of the owner of the (normalized) OpenID URL
+func registerOpenID(normalizedOpenID string, email string) error {
+	return writeStoreEntry("openids", createOpenIDHash(normalizedOpenID), []byte(normalizeEmail(email)))
+}
+
+// Returns the email address of the owner of the (normalized) OpenID URL, or an empty string if it is not registered
+func lookupOpenIDOwner(normalizedOpenID string) string {
+	data, err := readKey(createOpenIDPath(createOpenIDHash(normalizedOpenID)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Verifies that the email address is registered as owner of the (normalized) OpenID URL
+func verifyOpenIDOwner(normalizedOpenID string, email string) error {
+	owner := lookupOpenIDOwner(normalizedOpenID)
+	if owner == "" {
+		return fmt.Errorf("no email address is registered for OpenID URL '%s', please ask the administrator", normalizedOpenID)
+	}
+	if owner != normalizeEmail(email) {
+		return fmt.Errorf("the email address is not registered for OpenID URL '%s'", normalizedOpenID)
+	}
+	return nil
+}
+
+// Registers the owner of an OpenID URL, or removes the registration if no email is given
+func openIDCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	normalized, err := normalizeOpenID(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		if err := removeStoreEntry("openids", createOpenIDHash(normalized)); err != nil {
+			return err
+		}
+		log.Printf("Removed the owner of OpenID URL %s", normalized)
+		return nil
+	}
+	if err := registerOpenID(normalized, args[1]); err != nil {
+		return err
+	}
+	log.Printf("Registered %s as owner of OpenID URL %s", normalizeEmail(args[1]), normalized)
+	return nil
+}
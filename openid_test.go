@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeOpenID(t *testing.T) {
+	expected := map[string]string{
+		"HTTP://Example.COM":             "http://example.com/",
+		" https://ID.example.com/Alice ": "https://id.example.com/Alice",
+		"example.com/alice#frag":         "http://example.com/alice",
+	}
+	for openid, normalized := range expected {
+		actual, err := normalizeOpenID(openid)
+		if err != nil || actual != normalized {
+			t.Errorf("normalizeOpenID(%q) = %q (%v), expected %q", openid, actual, err, normalized)
+		}
+	}
+	if _, err := normalizeOpenID("ftp://example.com/"); err == nil {
+		t.Errorf("Expected error for non-http OpenID URL")
+	}
+}
+
+func TestVerifyOpenID(t *testing.T) {
+	defer func() { openIDHosts = []string{} }()
+
+	openIDHosts = []string{}
+	if verifyOpenID("https://id.example.com/alice") == nil {
+		t.Errorf("OpenID uploads should be disabled without hosts")
+	}
+	openIDHosts = []string{"id.example.com"}
+	if verifyOpenID("https://id.example.com/alice") != nil {
+		t.Errorf("OpenID URL on white listed host should be valid")
+	}
+	if verifyOpenID("https://evil.example.com/alice") == nil {
+		t.Errorf("OpenID URL on other host should not be valid")
+	}
+}
+
+// uploads an avatar via the upload form for the OpenID URL, confirming it immediately since email is not configured
+func uploadForOpenID(t *testing.T, email string, openid string) {
+	b := new(bytes.Buffer)
+	form := multipart.NewWriter(b)
+	form.WriteField("email", email)
+	form.WriteField("openid", openid)
+	part, _ := form.CreateFormFile("image", "avatar.jpg")
+	part.Write(createPortrait(64, 64).data)
+	form.Close()
+	r := httptest.NewRequest("POST", "/save", b)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	saveHandler(httptest.NewRecorder(), r, "")
+}
+
+func TestOpenIDUploadRequiresOwner(t *testing.T) {
+	defer useTempStorage(t)()
+	defer func() { openIDHosts = []string{} }()
+	openIDHosts = []string{"id.example.com"}
+	initTemplates()
+	openid := "https://id.example.com/ceo"
+	key := createAvatarPath(createOpenIDHash(openid))
+
+	uploadForOpenID(t, "ceo@example.com", openid)
+	if keyExists(key) {
+		t.Fatalf("Expected upload for unregistered OpenID URL to be rejected")
+	}
+	if err := openIDCommand([]string{openid, "CEO@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	uploadForOpenID(t, "someone@example.com", openid)
+	if keyExists(key) {
+		t.Fatalf("Expected upload by other email address to be rejected")
+	}
+	uploadForOpenID(t, "ceo@example.com", openid)
+	if !keyExists(key) {
+		t.Errorf("Expected upload by registered owner to be stored")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nfnt/resize"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sizes in prerender-sizes are rendered when an avatar is stored (see replaceCurrentAvatar), and stored as
+// prerendered/<hash>/<checksum>-<size>.<format> where checksum is (a prefix of) the checksum of the avatar they were
+// rendered from. Requests for these sizes are served from the storage without scaling. Renditions of a replaced avatar
+// are never served since the checksum doesn't match the metadata, they are removed by the background job that also
+// renders missing renditions.
+
+// Sizes and formats that are pre-rendered, no formats means the format of the uploaded image
+var (
+	prerenderSizes   = []int{}
+	prerenderFormats = []string{}
+)
+
+// Checksums as calculated by checksum, the metadata of hand-edited or imported avatars may contain other values
+var checksumRegExp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func getPrerenderedDir(hash string) string {
+	return getStoreDir("prerendered", hash)
+}
+
+func createPrerenderedPath(hash string, sum string, size int, format string) string {
+	return path.Join(getPrerenderedDir(hash), fmt.Sprintf("%s-%d.%s", sum[:16], size, format))
+}
+
+// Parses the comma-separated formats
+func parsePrerenderFormats(value string) ([]string, error) {
+	formats := []string{}
+	for _, format := range strings.Split(value, ",") {
+		if format = normalizeFormat(strings.TrimSpace(format)); format == "" {
+			continue
+		}
+		if !avatarFormats[format] {
+			return nil, fmt.Errorf("unsupported format '%s'", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// Parses the comma-separated sizes, sizes are limited to max-size
+func parsePrerenderSizes(value string) ([]int, error) {
+	sizes := []int{}
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		size, err := strconv.Atoi(s)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size '%s'", s)
+		}
+		sizes = append(sizes, max(min(size, *maxSize), minSize))
+	}
+	return sizes, nil
+}
+
+func isPrerenderedSize(size int) bool {
+	for _, s := range prerenderSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the pre-rendered size that is nearest to the size, or the size itself if no sizes are pre-rendered
+func nearestPrerenderedSize(size int) int {
+	nearest := size
+	for idx, s := range prerenderSizes {
+		if idx == 0 || abs(s-size) < abs(nearest-size) {
+			nearest = s
+		}
+	}
+	return nearest
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func getPrerenderFormats(metadata Metadata) []string {
+	if len(prerenderFormats) > 0 {
+		return prerenderFormats
+	}
+	if metadata.Format == "" {
+		return nil
+	}
+	return []string{metadata.Format}
+}
+
+// Reads the pre-rendered rendition for the request, returns nil if it is not pre-rendered
+func readPrerendered(hash string, metadata Metadata, request Request) *Avatar {
+	if !checksumRegExp.MatchString(metadata.Checksum) || request.format == "" || !isPrerenderedSize(request.size) {
+		return nil
+	}
+	key := createPrerenderedPath(hash, metadata.Checksum, request.size, request.format)
+	data, _, err := storage.Read(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", key, err)
+		}
+		return nil
+	}
+	return &Avatar{size: request.size, data: data, format: request.format, cacheControl: "max-age=300",
+		lastModified: formatLastModified(metadata.modified()), etag: createETag(metadata.Checksum, request)}
+}
+
+// Renders the missing renditions of the avatar and removes all other renditions, like those of previous avatars. The
+// checksum in the metadata is added or corrected if needed. The avatar must be locked.
+func prerender(hash string) (rendered int, err error) {
+	dir := getPrerenderedDir(hash)
+	existing, err := storage.List(dir)
+	if err != nil {
+		return 0, err
+	}
+	key := createAvatarPath(hash)
+	expected := map[string]bool{}
+	var data []byte
+	metadata := readMetadata(key)
+	if keyExists(createMetadataPath(key)) {
+		data, _, err = storage.Read(key)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if data != nil {
+		if sum := checksum(data); metadata.Checksum != sum {
+			metadata.Checksum = sum
+			if err := writeMetadata(key, metadata); err != nil {
+				return 0, err
+			}
+		}
+		for _, format := range getPrerenderFormats(metadata) {
+			for _, size := range prerenderSizes {
+				expected[path.Base(createPrerenderedPath(hash, metadata.Checksum, size, format))] = true
+			}
+		}
+	}
+	for _, name := range existing {
+		if expected[name] {
+			delete(expected, name)
+		} else if err := storage.Remove(path.Join(dir, name)); err != nil {
+			return 0, err
+		}
+	}
+	if len(expected) == 0 {
+		return 0, nil
+	}
+
+	// pre-rendering is done in the background or right after a change, there is no client to wait for
+	err = imageWork.run(context.Background(), func() error {
+		img, _, err := avatar2Image(&Avatar{data: data})
+		if err != nil {
+			return err
+		}
+		for _, format := range getPrerenderFormats(metadata) {
+			for _, size := range prerenderSizes {
+				target := createPrerenderedPath(hash, metadata.Checksum, size, format)
+				if !expected[path.Base(target)] {
+					continue
+				}
+				// rendered like scale does
+				rendition := &Avatar{size: size}
+				image2Avatar(rendition, resize.Resize(uint(size), uint(size), img, resize.Bicubic), format)
+				if err := storage.Write(target, rendition.data); err != nil {
+					return err
+				}
+				delete(expected, path.Base(target)) // sizes may be configured twice
+				rendered++
+			}
+		}
+		return nil
+	})
+	return rendered, err
+}
+
+// Pre-renders the avatar after it changed, a failure only means that the avatar is scaled on request. The avatar
+// must be locked.
+func prerenderChanged(hash string) {
+	if len(prerenderSizes) == 0 {
+		return
+	}
+	if _, err := prerender(hash); err != nil {
+		log.Printf("Failed to pre-render avatar %s: %v", hash, err)
+	}
+}
+
+// Pre-renders all avatars and removes the renditions of removed avatars
+func prerenderAll() error {
+	hashes, err := listAvatars()
+	if err != nil {
+		return err
+	}
+	dirs, err := listShardedDirs("prerendered")
+	if err != nil {
+		return err
+	}
+	// the renditions of removed avatars are removed as well
+	for _, dir := range dirs {
+		if hash := path.Base(dir); !keyExists(createAvatarPath(hash)) {
+			hashes = append(hashes, hash)
+		}
+	}
+	total, failed := 0, 0
+	for _, hash := range hashes {
+		unlock := lockAvatar(hash)
+		rendered, err := prerender(hash)
+		unlock()
+		if err != nil {
+			log.Printf("Failed to pre-render avatar %s: %v", hash, err)
+			failed++
+		}
+		total += rendered
+	}
+	log.Printf("Pre-rendered %d renditions of %d avatars, %d failed", total, len(hashes), failed)
+	return nil
+}
+
+// Runs prerenderAll at the interval
+func prerenderJob(interval time.Duration) {
+	for {
+		if err := prerenderAll(); err != nil {
+			log.Printf("Failed to pre-render avatars: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func prerenderCommand(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return prerenderAll()
+}
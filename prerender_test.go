@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func usePrerenderSizes(sizes ...int) (restore func()) {
+	previous := prerenderSizes
+	prerenderSizes = sizes
+	return func() { prerenderSizes = previous }
+}
+
+func TestPrerenderOnConfirm(t *testing.T) {
+	defer useTempStorage(t)()
+	defer usePrerenderSizes(16, 32)()
+	hash := createHash("someone@example.com")
+	pending := createUnconfirmedAvatarPath(hash, "0123456789abcdef")
+	if err := writeAvatar(pending, nil, createPortrait(64, 64), Metadata{Rating: "g", Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := promoteAvatar(pending, hash); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := storage.List(getPrerenderedDir(hash)); len(names) != 2 {
+		t.Fatalf("Expected 2 pre-rendered sizes, got %v", names)
+	}
+
+	// pre-rendered sizes are served without reading the avatar
+	if err := storage.Write(createAvatarPath(hash), []byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if img := decodeResponse(t, requestAvatar("/avatar/"+hash+"?s=32")); img.Bounds().Dx() != 32 {
+		t.Errorf("Expected pre-rendered size 32, got %d", img.Bounds().Dx())
+	}
+	if w := requestAvatar("/avatar/" + hash + "?s=48&d=404"); w.Code == http.StatusOK {
+		t.Errorf("Expected other sizes to be scaled from the (corrupt) avatar")
+	}
+}
+
+func TestPrerenderSnap(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer usePrerenderSizes(16, 32)()
+	defer func() { *prerenderSnap = false }()
+	*prerenderSnap = true
+
+	for size, expected := range map[int]int{20: 16, 30: 32, 200: 32} {
+		if img := decodeResponse(t, requestAvatar("/avatar/"+hash+"?s="+strconv.Itoa(size))); img.Bounds().Dx() != expected {
+			t.Errorf("Expected size %d to snap to %d, got %d", size, expected, img.Bounds().Dx())
+		}
+	}
+}
+
+func TestPrerenderAll(t *testing.T) {
+	defer useTempStorage(t)()
+	defer usePrerenderSizes(16)()
+	hash := createHash("someone@example.com")
+	key := createAvatarPath(hash)
+	if err := writeAvatar(key, nil, createPortrait(64, 64), Metadata{Rating: "g", Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := prerenderAll(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := storage.List(getPrerenderedDir(hash))
+
+	// the rendition of the replaced avatar is not served and replaced by the job
+	if err := writeAvatar(key, nil, createPortrait(32, 32), Metadata{Rating: "g", Format: "jpeg"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := requestAvatar("/avatar/" + hash + "?s=16"); w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expected rendition of the new avatar, got %s", w.Header().Get("Content-Type"))
+	}
+	if err := prerenderAll(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := storage.List(getPrerenderedDir(hash))
+	if len(first) != 1 || len(second) != 1 || first[0] == second[0] {
+		t.Errorf("Expected outdated rendition to be replaced, got %v and %v", first, second)
+	}
+
+	// renditions of removed avatars are removed
+	if err := removeAvatar(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := prerenderAll(); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := storage.List(getPrerenderedDir(hash)); len(names) != 0 {
+		t.Errorf("Expected renditions of removed avatar to be removed, got %v", names)
+	}
+}
+
+func TestNearestPrerenderedSize(t *testing.T) {
+	defer usePrerenderSizes(16, 32, 80)()
+	for size, expected := range map[int]int{8: 16, 16: 16, 25: 32, 60: 80, 512: 80} {
+		if actual := nearestPrerenderedSize(size); actual != expected {
+			t.Errorf("Expected %d for %d, got %d", expected, size, actual)
+		}
+	}
+}
+
+func TestPrerenderOnAdminReplace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intravatar-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer useTempStorage(t)()
+	defer usePrerenderSizes(16)()
+	email := "someone@example.com"
+	hash := createHash(email)
+
+	if err := storeAdminAvatar(email, bytes.NewReader(createPortrait(64, 64).data), "g", false); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := storage.List(getPrerenderedDir(hash)); len(names) != 1 {
+		t.Fatalf("Expected the imported avatar to be pre-rendered, got %v", names)
+	}
+	filename := exportToFile(t, dir)
+
+	// the imported avatar replaces a newer one, since the archive is imported with replace
+	if err := storeAdminAvatar(email, bytes.NewReader(createPortrait(32, 32).data), "g", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importArchive(filename, true, false); err != nil {
+		t.Fatal(err)
+	}
+	metadata := readMetadata(createAvatarPath(hash))
+	if names, _ := storage.List(getPrerenderedDir(hash)); len(names) != 1 ||
+		names[0] != path.Base(createPrerenderedPath(hash, metadata.Checksum, 16, metadata.Format)) {
+		t.Errorf("Expected the avatar of the archive to be pre-rendered, got %v", names)
+	}
+	if keyExists(createImportPath(hash)) {
+		t.Errorf("Expected the staged avatar to be moved")
+	}
+}
+
+func TestPrerenderedInvalidChecksum(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer usePrerenderSizes(16, 32)()
+	// hand-edited metadata
+	if err := writeMetadata(createAvatarPath(hash), Metadata{Rating: "g", Format: "png", Checksum: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if img := decodeResponse(t, requestAvatar("/avatar/"+hash+"?s=32")); img.Bounds().Dx() != 32 {
+		t.Errorf("Expected the avatar to be scaled, got size %d", img.Bounds().Dx())
+	}
+}
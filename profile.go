@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// suffix of a pending profile in the unconfirmed directory
+const profileSuffix = ".profile"
+
+// Formats in which a profile is served
+var profileFormats = map[string]string{
+	"json": "application/json",
+	"xml":  "application/xml",
+	"vcf":  "text/vcard",
+}
+
+var profileRegExp = regexp.MustCompile("^/([a-zA-Z0-9]+\\.(?:json|xml|vcf))$")
+
+// Link on a profile
+type Link struct {
+	Title string `json:"title" xml:"title"`
+	URL   string `json:"value" xml:"value"`
+}
+
+// Profile of the owner of an avatar
+type Profile struct {
+	DisplayName string `json:"displayName"`
+	Pronouns    string `json:"pronouns"`
+	JobTitle    string `json:"jobTitle"`
+	Location    string `json:"location"`
+	Links       []Link `json:"links"`
+	// Email of the uploader, only kept in pending profiles
+	Email string `json:"email,omitempty"`
+}
+
+func (p Profile) isEmpty() bool {
+	return p.DisplayName == "" && p.Pronouns == "" && p.JobTitle == "" && p.Location == "" && len(p.Links) == 0
+}
+
+func createProfilePath(hash string) string {
+	return createStorePath("profiles", hash)
+}
+
+func createPendingProfilePath(unconfirmedPath string) string {
+	return unconfirmedPath + profileSuffix
+}
+
+func readProfile(filename string) (*Profile, error) {
+	data, err := readKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	profile := &Profile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func writeProfile(filename string, profile *Profile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return storage.Write(filename, data)
+}
+
+// Reads the profile from the upload form. Links are entered one per line, optionally preceded by a title.
+func parseProfile(r *http.Request) (*Profile, error) {
+	profile := &Profile{
+		DisplayName: strings.TrimSpace(r.FormValue("displayName")),
+		Pronouns:    strings.TrimSpace(r.FormValue("pronouns")),
+		JobTitle:    strings.TrimSpace(r.FormValue("jobTitle")),
+		Location:    strings.TrimSpace(r.FormValue("location")),
+	}
+	for _, line := range strings.Split(r.FormValue("links"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		link := fields[len(fields)-1]
+		if !isWebLink(link) {
+			return nil, fmt.Errorf("invalid link '%s', only http and https links are allowed", link)
+		}
+		profile.Links = append(profile.Links, Link{Title: strings.Join(fields[:len(fields)-1], " "), URL: link})
+	}
+	return profile, nil
+}
+
+// Returns true if the link is an absolute http or https URL
+func isWebLink(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Moves a pending profile (if any) to the profile of the hash
+func confirmProfile(unconfirmedPath string, hash string) error {
+	pending := createPendingProfilePath(unconfirmedPath)
+	if !keyExists(pending) {
+		return nil
+	}
+	profile, err := readProfile(pending)
+	if err != nil {
+		return err
+	}
+	if err := registerConfirmedEmail(profile.Email, hash); err != nil {
+		return err
+	}
+	return updateStoreEntry("profiles", hash, func(key string) error {
+		if profile.Email == "" {
+			return storage.Rename(pending, key)
+		}
+		profile.Email = ""
+		if err := writeProfile(key, profile); err != nil {
+			return err
+		}
+		return storage.Remove(pending)
+	})
+}
+
+// Profile entry in the format used by gravatar
+type profileEntry struct {
+	XMLName      xml.Name `json:"-" xml:"entry"`
+	ID           string   `json:"id" xml:"id"`
+	Hash         string   `json:"hash" xml:"hash"`
+	RequestHash  string   `json:"requestHash" xml:"requestHash"`
+	ProfileURL   string   `json:"profileUrl" xml:"profileUrl"`
+	ThumbnailURL string   `json:"thumbnailUrl" xml:"thumbnailUrl"`
+	Photos       []photo  `json:"photos" xml:"photos"`
+	DisplayName  string   `json:"displayName,omitempty" xml:"displayName,omitempty"`
+	Pronouns     string   `json:"pronouns,omitempty" xml:"pronouns,omitempty"`
+	JobTitle     string   `json:"job_title,omitempty" xml:"job_title,omitempty"`
+	Location     string   `json:"currentLocation,omitempty" xml:"currentLocation,omitempty"`
+	URLs         []Link   `json:"urls" xml:"urls"`
+}
+
+type photo struct {
+	Value string `json:"value" xml:"value"`
+	Type  string `json:"type" xml:"type"`
+}
+
+func createProfileEntry(requestHash string, hash string, profile *Profile) profileEntry {
+	avatarURL := getServiceURL() + "avatar/" + hash
+	entry := profileEntry{
+		ID:           hash,
+		Hash:         hash,
+		RequestHash:  requestHash,
+		ProfileURL:   getServiceURL() + requestHash,
+		ThumbnailURL: avatarURL,
+		Photos:       []photo{{Value: avatarURL, Type: "thumbnail"}},
+		DisplayName:  profile.DisplayName,
+		Pronouns:     profile.Pronouns,
+		JobTitle:     profile.JobTitle,
+		Location:     profile.Location,
+		URLs:         []Link{},
+	}
+	// profiles stored by older versions or imported from an archive may contain other links
+	for _, link := range profile.Links {
+		if isWebLink(link.URL) {
+			entry.URLs = append(entry.URLs, link)
+		}
+	}
+	return entry
+}
+
+// escapes a vCard property value
+func vcardEscape(value string) string {
+	return strings.NewReplacer("\\", "\\\\", ",", "\\,", ";", "\\;", "\r\n", "\\n", "\r", "\\n", "\n", "\\n").Replace(value)
+}
+
+func writeVCard(w http.ResponseWriter, entry profileEntry) {
+	lines := []string{"BEGIN:VCARD", "VERSION:4.0"}
+	name := entry.DisplayName
+	if name == "" {
+		name = entry.Hash
+	}
+	lines = append(lines, "FN:"+vcardEscape(name))
+	if entry.Pronouns != "" {
+		lines = append(lines, "PRONOUNS:"+vcardEscape(entry.Pronouns))
+	}
+	if entry.JobTitle != "" {
+		lines = append(lines, "TITLE:"+vcardEscape(entry.JobTitle))
+	}
+	if entry.Location != "" {
+		lines = append(lines, "ADR:;;;"+vcardEscape(entry.Location)+";;;")
+	}
+	lines = append(lines, "PHOTO:"+vcardEscape(entry.ThumbnailURL))
+	for _, link := range entry.URLs {
+		lines = append(lines, "URL:"+vcardEscape(link.URL))
+	}
+	lines = append(lines, "END:VCARD")
+	fmt.Fprint(w, strings.Join(lines, "\r\n")+"\r\n")
+}
+
+func serveProfile(w http.ResponseWriter, r *http.Request, requestHash string, format string) {
+	hash := resolveHash(requestHash)
+	profile, err := readProfile(createProfilePath(hash))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading profile: %v", err)
+		}
+		if !keyExists(createAvatarPath(hash)) {
+			http.NotFound(w, r)
+			return
+		}
+		profile = &Profile{}
+	}
+	entry := createProfileEntry(requestHash, hash, profile)
+
+	w.Header().Set("Content-Type", profileFormats[format])
+	switch format {
+	case "json":
+		err = json.NewEncoder(w).Encode(map[string][]profileEntry{"entry": {entry}})
+	case "xml":
+		fmt.Fprint(w, xml.Header)
+		err = xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name     `xml:"response"`
+			Entry   profileEntry `xml:"entry"`
+		}{Entry: entry})
+	case "vcf":
+		writeVCard(w, entry)
+	}
+	if err != nil {
+		log.Printf("Error writing profile: %v", err)
+	}
+}
+
+// Handles requests for /<hash>.<format>, title is the last part of the path
+func profileHandler(w http.ResponseWriter, r *http.Request, title string) {
+	splitted := strings.SplitN(title, ".", 2)
+	serveProfile(w, r, splitted[0], splitted[1])
+}
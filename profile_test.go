@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeProfile(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	profile := &Profile{DisplayName: "Some One", JobTitle: "Engineer", Links: []Link{{Title: "Blog", URL: "https://example.com"}}}
+	if err := writeProfile(createProfilePath(hash), profile); err != nil {
+		t.Fatal(err)
+	}
+
+	w := requestAvatar("/avatar/" + hash + ".json")
+	var response struct {
+		Entry []map[string]interface{} `json:"entry"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Entry) != 1 || response.Entry[0]["displayName"] != "Some One" || response.Entry[0]["job_title"] != "Engineer" {
+		t.Errorf("Unexpected profile %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	profileHandler(w, httptest.NewRequest("GET", "/"+hash+".vcf", nil), hash+".vcf")
+	if !strings.Contains(w.Body.String(), "FN:Some One\r\n") || !strings.Contains(w.Body.String(), "URL:https://example.com\r\n") {
+		t.Errorf("Unexpected vCard %s", w.Body.String())
+	}
+
+	w = requestAvatar("/avatar/" + createHash("unknown@example.com") + ".xml")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown profile, got %d", w.Code)
+	}
+}
+
+func TestVCardEscaping(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	profile := &Profile{DisplayName: "Some One\rEMAIL:evil@example.com", Links: []Link{{URL: "javascript:alert(1)"}}}
+	if err := writeProfile(createProfilePath(hash), profile); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	profileHandler(w, httptest.NewRequest("GET", "/"+hash+".vcf", nil), hash+".vcf")
+	if !strings.Contains(w.Body.String(), "FN:Some One\\nEMAIL:evil@example.com\r\n") {
+		t.Errorf("Expected carriage return to be escaped: %q", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "javascript") {
+		t.Errorf("Expected javascript link to be omitted: %q", w.Body.String())
+	}
+}
+
+func TestParseProfileLinks(t *testing.T) {
+	r := httptest.NewRequest("POST", "/save", strings.NewReader("links=Blog+https%3A%2F%2Fexample.com%0Ajavascript%3Aalert(1)"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := parseProfile(r); err == nil {
+		t.Errorf("Expected javascript link to be rejected")
+	}
+}
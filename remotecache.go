@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Responses of remote services are cached on disk, keyed by the url which contains the remote, hash, size, default,
+// format and rating. The freshness of a response is determined by its Cache-Control or Expires header, expired
+// responses are revalidated with If-None-Match and If-Modified-Since. If the remote can not be reached, the stale
+// response is used. Not found responses are cached for remote-cache-404-ttl.
+
+// Client for the remote services, the timeouts are set per request with the context
+var remoteClient = &http.Client{}
+
+// Cache of remote responses, nil if disabled
+var remoteCache Storage
+
+// Cached response of a remote service, stored as <key>.json next to the image data
+type remoteEntry struct {
+	URL          string    `json:"url"`
+	Status       int       `json:"status"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+func createRemoteCacheKey(remote string) string {
+	sum := checksum([]byte(remote))
+	return createShardedPath("", sum, sum)
+}
+
+func readRemoteEntry(key string) (*remoteEntry, []byte) {
+	data, _, err := remoteCache.Read(key + metadataSuffix)
+	if err != nil {
+		return nil, nil
+	}
+	entry := &remoteEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		log.Printf("Invalid remote cache entry %s: %v", key, err)
+		return nil, nil
+	}
+	if entry.Status != http.StatusOK {
+		return entry, nil
+	}
+	data, _, err = remoteCache.Read(key)
+	if err != nil {
+		return nil, nil
+	}
+	return entry, data
+}
+
+func writeRemoteEntry(key string, entry *remoteEntry, data []byte) {
+	metadata, err := json.Marshal(entry)
+	if err == nil && data != nil {
+		err = remoteCache.Write(key, data)
+	}
+	if err == nil {
+		err = remoteCache.Write(key+metadataSuffix, metadata)
+	}
+	if err != nil {
+		log.Printf("Failed to cache response of %s: %v", entry.URL, err)
+	}
+}
+
+// Returns how long the response may be cached, and false if it may not be stored at all
+func responseFreshness(header http.Header, now time.Time) (time.Duration, bool) {
+	var maxAge, sharedMaxAge = -1, -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name := strings.ToLower(strings.TrimSpace(directive))
+		value := ""
+		if idx := strings.Index(name, "="); idx >= 0 {
+			name, value = name[:idx], strings.Trim(name[idx+1:], "\"")
+		}
+		switch name {
+		case "no-store", "private":
+			return 0, false
+		case "no-cache":
+			return 0, true
+		case "max-age":
+			maxAge, _ = strconv.Atoi(value)
+		case "s-maxage":
+			sharedMaxAge, _ = strconv.Atoi(value)
+		}
+	}
+	if sharedMaxAge >= 0 {
+		return time.Duration(sharedMaxAge) * time.Second, true
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true // invalid values mean expired
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return expiresAt.Sub(date), true
+	}
+	return *remoteCacheTTL, true
+}
+
+// Creates the avatar from the cached response, or nil if it is a not found response. The freshness of the remote
+// response only applies to the cache, clients get the same short max-age as for uncached responses: remote services
+// may send very long max-ages, and clients should notice soon when an avatar is uploaded here.
+func cachedAvatar(entry *remoteEntry, data []byte) *Avatar {
+	if entry.Status != http.StatusOK {
+		return nil
+	}
+	return &Avatar{size: -1, data: data, format: contentTypeFormat(entry.ContentType), lastModified: entry.LastModified,
+		cacheControl: "max-age=300"}
+}
+
+// Retrieves the url from the remote service, using the cache if enabled. Returns nil if there is no avatar or it
+// could not be retrieved.
+func fetchRemote(ctx context.Context, remote string) *Avatar {
+	now := time.Now()
+	var key string
+	var entry *remoteEntry
+	var data []byte
+	if remoteCache != nil {
+		key = createRemoteCacheKey(remote)
+		entry, data = readRemoteEntry(key)
+		if entry != nil && now.Before(entry.Expires) {
+			return cachedAvatar(entry, data)
+		}
+	}
+
+	log.Printf("Retrieving from: %s", remote)
+	req, err := http.NewRequestWithContext(ctx, "GET", remote, nil)
+	if err != nil {
+		log.Printf("Invalid remote url %s: %v", remote, err)
+		return nil
+	}
+	if entry != nil && entry.Status == http.StatusOK && entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+	if entry != nil && entry.Status == http.StatusOK && entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+	resp, err := remoteClient.Do(req)
+	if err == nil && resp.StatusCode >= 500 {
+		resp.Body.Close()
+		err = fmt.Errorf("remote returned %s", resp.Status)
+	}
+	if err != nil && ctx.Err() == context.Canceled {
+		return nil // the client went away, or another remote service already has the avatar
+	}
+	if err != nil {
+		if entry != nil && now.Sub(entry.Expires) < *remoteCacheMaxStale {
+			log.Printf("Remote lookup of %s failed with error: %s, using cached response", remote, err)
+			return cachedAvatar(entry, data)
+		}
+		log.Printf("Remote lookup of %s failed with error: %s", remote, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		if ttl, ok := responseFreshness(resp.Header, now); ok && remoteCache != nil {
+			entry.Expires = now.Add(ttl)
+			writeRemoteEntry(key, entry, nil)
+		}
+		return cachedAvatar(entry, data)
+	case resp.StatusCode == http.StatusOK:
+		avatar, err := strictReadImage(resp.Body)
+		if err != nil {
+			log.Printf("Failed to read response of %s: %v", remote, err)
+			return nil
+		}
+		avatar.lastModified = resp.Header.Get("Last-Modified")
+		avatar.format = contentTypeFormat(resp.Header.Get("Content-Type"))
+		avatar.cacheControl = "max-age=300"
+		if ttl, ok := responseFreshness(resp.Header, now); ok && remoteCache != nil {
+			entry = &remoteEntry{URL: remote, Status: http.StatusOK, ETag: resp.Header.Get("ETag"),
+				LastModified: avatar.lastModified, ContentType: resp.Header.Get("Content-Type"), Expires: now.Add(ttl)}
+			writeRemoteEntry(key, entry, avatar.data)
+			return cachedAvatar(entry, avatar.data)
+		}
+		return avatar
+	default:
+		// not found, and any other client error, is cached with its own ttl
+		log.Printf("Avatar not found on %s (%s)", remote, resp.Status)
+		if remoteCache != nil {
+			writeRemoteEntry(key, &remoteEntry{URL: remote, Status: resp.StatusCode, Expires: now.Add(*remoteNotFoundTTL)}, nil)
+		}
+		return nil
+	}
+}
+
+// Enables the remote cache and periodically removes the entries that are too old to be used
+func startRemoteCache() {
+	dir := *remoteCacheDir
+	if dir == "" {
+		dir = filepath.Join(*dataDir, "remotecache")
+	}
+	log.Printf("Caching remote responses in %s", dir)
+	remoteCache = &fileStorage{root: dir}
+	go func() {
+		for {
+			sweepRemoteCache(dir)
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+// Removes the cached responses that expired more than remote-cache-max-stale ago
+func sweepRemoteCache(dir string) {
+	removed := 0
+	filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(filename, metadataSuffix) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil
+		}
+		entry := &remoteEntry{}
+		if json.Unmarshal(data, entry) != nil || time.Since(entry.Expires) > *remoteCacheMaxStale {
+			os.Remove(filename)
+			os.Remove(strings.TrimSuffix(filename, metadataSuffix))
+			removed++
+		}
+		return nil
+	})
+	log.Printf("Removed %d expired responses from the remote cache", removed)
+}
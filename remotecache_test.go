@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// fake remote service that counts the requests
+type fakeRemote struct {
+	requests     int
+	conditionals int
+	status       int
+	cacheControl string
+	data         []byte
+}
+
+func (f *fakeRemote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests++
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		f.conditionals++
+		w.Header().Set("Cache-Control", f.cacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if f.status != http.StatusOK {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Cache-Control", f.cacheControl)
+	w.Write(f.data)
+}
+
+func useTempRemoteCache(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "remotecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCache = &fileStorage{root: dir}
+	return func() {
+		remoteCache = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	defer useTempRemoteCache(t)()
+	remote := &fakeRemote{status: http.StatusOK, cacheControl: "max-age=60", data: createPortrait(16, 16).data}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	url := server.URL + "/hash?s=16"
+
+	for i := 0; i < 2; i++ {
+		if avatar := fetchRemote(context.Background(), url); avatar == nil || len(avatar.data) != len(remote.data) {
+			t.Fatalf("Expected the remote avatar")
+		}
+	}
+	if remote.requests != 1 {
+		t.Errorf("Expected fresh response to be served from the cache, got %d requests", remote.requests)
+	}
+
+	// expire the entry, it is revalidated
+	key := createRemoteCacheKey(url)
+	entry, data := readRemoteEntry(key)
+	entry.Expires = time.Now().Add(-time.Minute)
+	writeRemoteEntry(key, entry, data)
+	if avatar := fetchRemote(context.Background(), url); avatar == nil || avatar.cacheControl != "max-age=300" {
+		t.Fatalf("Expected revalidated avatar with the max-age for clients, got %+v", avatar)
+	}
+	if remote.conditionals != 1 {
+		t.Errorf("Expected a conditional request, got %d", remote.conditionals)
+	}
+
+	// expired entry is used if the remote is down
+	entry.Expires = time.Now().Add(-time.Minute)
+	writeRemoteEntry(key, entry, data)
+	server.Close()
+	if avatar := fetchRemote(context.Background(), url); avatar == nil {
+		t.Errorf("Expected stale avatar when remote is unreachable")
+	}
+}
+
+func TestRemoteCacheNotFound(t *testing.T) {
+	defer useTempRemoteCache(t)()
+	remote := &fakeRemote{status: http.StatusNotFound}
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	url := server.URL + "/hash?d=404"
+
+	for i := 0; i < 2; i++ {
+		if avatar := fetchRemote(context.Background(), url); avatar != nil {
+			t.Fatalf("Expected no avatar")
+		}
+	}
+	if remote.requests != 1 {
+		t.Errorf("Expected not found response to be cached, got %d requests", remote.requests)
+	}
+	entry, _ := readRemoteEntry(createRemoteCacheKey(url))
+	if ttl := time.Until(entry.Expires); ttl > *remoteNotFoundTTL || ttl < *remoteNotFoundTTL-time.Minute {
+		t.Errorf("Expected not found response to be cached for %v, got %v", *remoteNotFoundTTL, ttl)
+	}
+}
+
+func TestResponseFreshness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		header http.Header
+		ttl    time.Duration
+		store  bool
+	}{
+		{http.Header{}, *remoteCacheTTL, true},
+		{http.Header{"Cache-Control": {"public, max-age=120"}}, 2 * time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=120, s-maxage=30"}}, 30 * time.Second, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, 0, true},
+		{http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{http.Header{"Date": {now.UTC().Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Hour, true},
+	}
+	for _, test := range tests {
+		ttl, store := responseFreshness(test.header, now)
+		if store != test.store || (ttl-test.ttl).Round(time.Second) != 0 {
+			t.Errorf("Expected %v, %v for %v, got %v, %v", test.ttl, test.store, test.header, ttl, store)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage of the avatars and their related data. Keys are slash-separated paths like 'avatars/<hash>', the first
+// part being the store (avatars, unconfirmed, profiles, ...).
+type Storage interface {
+	// Returns the data and the time it was last modified, or an error for which os.IsNotExist is true if the
+	// key does not exist
+	Read(key string) ([]byte, time.Time, error)
+	// Stores the data under the key, replacing any existing data
+	Write(key string, data []byte) error
+	// Moves the data to another key, replacing any existing data under that key. This is atomic for the file and
+	// SQL storage, but not for the S3 storage (see s3Storage.Rename).
+	Rename(from string, to string) error
+	// Removes the key, removing a key that does not exist is not an error
+	Remove(key string) error
+	Exists(key string) (bool, error)
+	// Returns the (sorted) names of the keys directly below dir
+	List(dir string) ([]string, error)
+	// Returns the (sorted) names of the directories directly below dir, a directory being a common prefix of keys
+	ListDirs(dir string) ([]string, error)
+}
+
+var storage Storage
+
+// Creates the configured storage
+func createStorage() (Storage, error) {
+	switch *storageType {
+	case "fs":
+		createDirectoryStructure()
+		return &fileStorage{root: *dataDir}, nil
+	case "s3":
+		return createS3Storage(*s3Endpoint, *s3Region, *s3Bucket, *s3AccessKey, *s3SecretKey)
+	case "sql":
+		return createSQLStorage(*sqlDriver, *sqlDSN)
+	}
+	return nil, fmt.Errorf("unknown storage type '%s'", *storageType)
+}
+
+// Returns true if the key exists, errors are logged and result in false
+func keyExists(key string) bool {
+	ok, err := storage.Exists(key)
+	if err != nil {
+		log.Printf("Error looking up %s: %v", key, err)
+	}
+	return ok
+}
+
+func readKey(key string) ([]byte, error) {
+	data, _, err := storage.Read(key)
+	return data, err
+}
+
+// prefix of the temporary files that are renamed to their key once completely written
+const tempPrefix = ".tmp-"
+
+// Stores keys as files below the data dir. All mutations are synced to disk before they return.
+type fileStorage struct {
+	root string
+}
+
+func (s *fileStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *fileStorage) Read(key string) ([]byte, time.Time, error) {
+	filename := s.path(key)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, info.ModTime(), nil
+}
+
+// Creates the directory and its missing parents. The parents are synced so that new directories survive a crash.
+func (s *fileStorage) mkdir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if err := s.mkdir(parent); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+// Syncs the directory, making the creation, removal or renaming of its entries durable
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil // directories can not be synced on windows
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Writes the data to a temporary file which is renamed to the key when it is completely written and synced, so
+// that a crash never leaves a partially written file
+func (s *fileStorage) Write(key string, data []byte) error {
+	filename := s.path(key)
+	dir := filepath.Dir(filename)
+	if err := s.mkdir(dir); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (s *fileStorage) Rename(from string, to string) error {
+	source := s.path(from)
+	target := s.path(to)
+	if err := s.mkdir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if err := os.Rename(source, target); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if filepath.Dir(source) != filepath.Dir(target) {
+		return syncDir(filepath.Dir(source))
+	}
+	return nil
+}
+
+func (s *fileStorage) Remove(key string) error {
+	filename := s.path(key)
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+func (s *fileStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *fileStorage) List(dir string) ([]string, error) {
+	return s.list(dir, false)
+}
+
+func (s *fileStorage) ListDirs(dir string) ([]string, error) {
+	return s.list(dir, true)
+}
+
+func (s *fileStorage) list(dir string, dirs bool) ([]string, error) {
+	files, err := ioutil.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if file.IsDir() == dirs && !strings.HasPrefix(file.Name(), tempPrefix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stores keys as objects in a bucket of an S3-compatible service, like MinIO. Objects are addressed path-style
+// (<endpoint>/<bucket>/<key>) and requests are signed with AWS signature version 4.
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func createS3Storage(endpoint, region, bucket, accessKey, secretKey string) (*s3Storage, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("s3-endpoint and s3-bucket are required for s3 storage")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// escapes the path as required for the canonical request, keeping the slashes
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		segments[idx] = strings.Replace(url.PathEscape(segment), "+", "%2B", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// signs the request using AWS signature version 4
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var headerNames []string
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := req.URL.Query()
+	var queryParts []string
+	for name, values := range query {
+		for _, value := range values {
+			queryParts = append(queryParts, url.QueryEscape(name)+"="+strings.Replace(url.QueryEscape(value), "+", "%20", -1))
+		}
+	}
+	sort.Strings(queryParts)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.Join(queryParts, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *s3Storage) do(method string, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, sha256Hex(body), time.Now())
+	return s.client.Do(req)
+}
+
+// performs the request and returns the body, a 404 results in an os.ErrNotExist error
+func (s *s3Storage) call(method string, key string, query url.Values, body []byte, header http.Header) ([]byte, http.Header, error) {
+	resp, err := s.do(method, key, query, body, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		return nil, nil, fmt.Errorf("s3 %s %s failed with status %s: %s", method, key, resp.Status, data)
+	}
+	return data, resp.Header, nil
+}
+
+func (s *s3Storage) Read(key string) ([]byte, time.Time, error) {
+	data, header, err := s.call("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	modified, _ := http.ParseTime(header.Get("Last-Modified"))
+	return data, modified, nil
+}
+
+func (s *s3Storage) Write(key string, data []byte) error {
+	_, _, err := s.call("PUT", key, nil, data, http.Header{"Content-Type": {"application/octet-stream"}})
+	return err
+}
+
+// S3 has no rename, the object is copied and the source is removed afterwards. This is not atomic: readers never
+// see a partially written destination, but after a crash between the copy and the removal both keys exist.
+// Callers that rely on an atomic rename for crash-safety (like moveAvatar) may then find the source again, for
+// example an unconfirmed avatar that was already confirmed.
+func (s *s3Storage) Rename(from string, to string) error {
+	source := "/" + s.bucket + "/" + s3EscapePath(from)
+	if _, _, err := s.call("PUT", to, nil, nil, http.Header{"X-Amz-Copy-Source": {source}}); err != nil {
+		return err
+	}
+	return s.Remove(from)
+}
+
+func (s *s3Storage) Remove(key string) error {
+	_, _, err := s.call("DELETE", key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *s3Storage) Exists(key string) (bool, error) {
+	_, _, err := s.call("HEAD", key, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Storage) List(dir string) ([]string, error) {
+	names, _, err := s.list(dir)
+	return names, err
+}
+
+func (s *s3Storage) ListDirs(dir string) ([]string, error) {
+	_, dirs, err := s.list(dir)
+	return dirs, err
+}
+
+// returns the names of the keys and the directories (common prefixes) below dir
+func (s *s3Storage) list(dir string) (names []string, dirs []string, err error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	for {
+		data, _, err := s.call("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, nil, err
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, prefix))
+		}
+		for _, common := range result.CommonPrefixes {
+			dirs = append(dirs, strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/"))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(names)
+	sort.Strings(dirs)
+	return names, dirs, nil
+}
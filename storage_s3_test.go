@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// In-memory fake of the part of the S3 API that is used by s3Storage
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+var s3AuthorizationRegExp = regexp.MustCompile(
+	"^AWS4-HMAC-SHA256 Credential=access/([0-9]{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$")
+
+// Verifies the AWS signature version 4 of the request for the secret key 'secret', as S3 does. The canonical
+// request is built from the request as received, so that encoding differences between signing and sending are
+// detected.
+func verifyS3Signature(r *http.Request, body []byte) bool {
+	match := s3AuthorizationRegExp.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return false
+	}
+	date, region, signedHeaders, signature := match[1], match[2], match[3], match[4]
+	amzDate := r.Header.Get("X-Amz-Date")
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if !strings.HasPrefix(amzDate, date) || payloadHash != sha256Hex(body) {
+		return false
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	var queryParts []string
+	if r.URL.RawQuery != "" {
+		queryParts = strings.Split(r.URL.RawQuery, "&")
+	}
+	sort.Strings(queryParts)
+	canonicalRequest := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(queryParts, "&"),
+		canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4secret"), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)) == signature
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if !verifyS3Signature(r, body) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == "GET" && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+		}
+		var keys []string
+		prefixes := map[string]bool{}
+		for k := range f.objects {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if idx := strings.Index(k[len(prefix):], "/"); idx >= 0 {
+				prefixes[k[:len(prefix)+idx+1]] = true
+			} else {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{k})
+		}
+		for p := range prefixes {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{p})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "PUT":
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			sourceKey, _ := url.PathUnescape(strings.TrimPrefix(source, "/bucket/"))
+			data, ok := f.objects[sourceKey]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			f.objects[key] = data
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", "Sat, 01 Jan 2000 12:00:00 GMT")
+		w.Write(data)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+	s, err := createS3Storage(server.URL, "us-east-1", "bucket", "access", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+}
+
+func TestS3StorageSignature(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer server.Close()
+	s, err := createS3Storage(server.URL, "us-east-1", "bucket", "access", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write("avatars/hash", []byte("data")); err == nil {
+		t.Errorf("Expected request signed with the wrong secret key to be rejected")
+	}
+}
+
+// Runs the storage tests against a real S3-compatible service, like MinIO, if INTRAVATAR_TEST_S3_ENDPOINT is set.
+// The bucket (INTRAVATAR_TEST_S3_BUCKET) must exist and be empty. For example:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	INTRAVATAR_TEST_S3_ENDPOINT=http://localhost:9000 INTRAVATAR_TEST_S3_BUCKET=test \
+//	INTRAVATAR_TEST_S3_ACCESS_KEY=minioadmin INTRAVATAR_TEST_S3_SECRET_KEY=minioadmin go test -run TestS3StorageService
+func TestS3StorageService(t *testing.T) {
+	endpoint := os.Getenv("INTRAVATAR_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("INTRAVATAR_TEST_S3_ENDPOINT is not set")
+	}
+	region := os.Getenv("INTRAVATAR_TEST_S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	s, err := createS3Storage(endpoint, region, os.Getenv("INTRAVATAR_TEST_S3_BUCKET"),
+		os.Getenv("INTRAVATAR_TEST_S3_ACCESS_KEY"), os.Getenv("INTRAVATAR_TEST_S3_SECRET_KEY"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+}
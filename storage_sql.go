@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // postgres driver
+)
+
+const sqlTable = "intravatar_objects"
+
+// Stores keys as rows in a single table of an SQL database. Supported are postgres and, when built with cgo,
+// sqlite3.
+type sqlStorage struct {
+	db     *sql.DB
+	driver string
+}
+
+func createSQLStorage(driver string, dsn string) (*sqlStorage, error) {
+	if dsn == "" {
+		return nil, errors.New("sql-dsn is required for sql storage")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database (note that sqlite3 requires a build with cgo): %v", driver, err)
+	}
+	s := &sqlStorage{db: db, driver: driver}
+	_, err = db.Exec(s.query("CREATE TABLE IF NOT EXISTS " + sqlTable +
+		" (name VARCHAR(512) PRIMARY KEY, data BYTEA NOT NULL, modified BIGINT NOT NULL)"))
+	if err == nil && driver == "postgres" {
+		// listing compares names byte-wise, which the primary key doesn't support with a locale collation
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS " + sqlTable + "_name_c ON " + sqlTable + " (name COLLATE \"C\")")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the name column with byte-wise collation. The default collation of sqlite is byte-wise, postgres may use
+// the collation of a locale that sorts for example '/' after letters.
+func (s *sqlStorage) nameColumn() string {
+	if s.driver == "postgres" {
+		return "name COLLATE \"C\""
+	}
+	return "name"
+}
+
+// replaces the '?' placeholders by the placeholders of the driver
+func (s *sqlStorage) query(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func notExist(key string) error {
+	return &os.PathError{Op: "read", Path: key, Err: os.ErrNotExist}
+}
+
+func (s *sqlStorage) Read(key string) ([]byte, time.Time, error) {
+	var data []byte
+	var modified int64
+	err := s.db.QueryRow(s.query("SELECT data, modified FROM "+sqlTable+" WHERE name = ?"), key).Scan(&data, &modified)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, notExist(key)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, time.Unix(0, modified), nil
+}
+
+func (s *sqlStorage) Write(key string, data []byte) error {
+	_, err := s.db.Exec(s.query("INSERT INTO "+sqlTable+" (name, data, modified) VALUES (?, ?, ?) "+
+		"ON CONFLICT (name) DO UPDATE SET data = excluded.data, modified = excluded.modified"),
+		key, data, time.Now().UnixNano())
+	return err
+}
+
+func (s *sqlStorage) Rename(from string, to string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.query("DELETE FROM "+sqlTable+" WHERE name = ?"), to); err != nil {
+		return err
+	}
+	result, err := tx.Exec(s.query("UPDATE "+sqlTable+" SET name = ? WHERE name = ?"), to, from)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notExist(from)
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStorage) Remove(key string) error {
+	_, err := s.db.Exec(s.query("DELETE FROM "+sqlTable+" WHERE name = ?"), key)
+	return err
+}
+
+func (s *sqlStorage) Exists(key string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(s.query("SELECT COUNT(*) FROM "+sqlTable+" WHERE name = ?"), key).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqlStorage) List(dir string) ([]string, error) {
+	return s.list(dir, false)
+}
+
+func (s *sqlStorage) ListDirs(dir string) ([]string, error) {
+	return s.list(dir, true)
+}
+
+func (s *sqlStorage) list(dir string, dirs bool) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	// all names that start with the prefix, as a range so that the index is used ('0' follows '/')
+	name := s.nameColumn()
+	rows, err := s.db.Query(s.query("SELECT name FROM "+sqlTable+" WHERE "+name+" >= ? AND "+name+" < ? ORDER BY "+name),
+		prefix, strings.TrimSuffix(prefix, "/")+"0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	seen := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		name = strings.TrimPrefix(name, prefix)
+		idx := strings.Index(name, "/")
+		if !dirs && idx < 0 {
+			names = append(names, name)
+		} else if dirs && idx >= 0 && !seen[name[:idx]] {
+			// the rows of a directory are adjacent in byte order, but not necessarily in the order of a collation
+			seen[name[:idx]] = true
+			names = append(names, name[:idx])
+		}
+	}
+	// sorted by name like the files of a directory, 'a-b/x' precedes 'a/x' in the rows since '-' precedes '/'
+	sort.Strings(names)
+	return names, rows.Err()
+}
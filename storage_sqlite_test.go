@@ -0,0 +1,25 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intravatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := createSQLStorage("sqlite3", filepath.Join(dir, "intravatar.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	testStorage(t, s)
+}
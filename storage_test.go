@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// uses file storage in a temporary data dir
+func useTempStorage(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "intravatar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*dataDir = dir
+	createDirectoryStructure()
+	storage = &fileStorage{root: dir}
+	if err := initLayout(); err != nil {
+		t.Fatal(err)
+	}
+	return func() { os.RemoveAll(dir) }
+}
+
+// verifies the contract of the Storage interface
+func testStorage(t *testing.T, s Storage) {
+	if _, _, err := s.Read("avatars/missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error for missing key, got %v", err)
+	}
+	if err := s.Write("unconfirmed/token-hash", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists("unconfirmed/token-hash"); !ok || err != nil {
+		t.Errorf("Expected written key to exist (%v)", err)
+	}
+	if err := s.Write("unconfirmed/token-hash.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := s.List("unconfirmed"); err != nil || !reflect.DeepEqual(names, []string{"token-hash", "token-hash.json"}) {
+		t.Errorf("Unexpected list result %v (%v)", names, err)
+	}
+	// keys in subdirectories and in directories with the same prefix are not listed
+	for _, key := range []string{"unconfirmed/to/ke/token-hash", "unconfirmed/to/kf/token-hash", "unconfirmed/to-x/ke",
+		"unconfirmed-x/token-hash", "unconfirmed0"} {
+		if err := s.Write(key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Remove(key)
+	}
+	if names, err := s.List("unconfirmed"); err != nil || !reflect.DeepEqual(names, []string{"token-hash", "token-hash.json"}) {
+		t.Errorf("Unexpected list result with subdirectories %v (%v)", names, err)
+	}
+	if dirs, err := s.ListDirs("unconfirmed"); err != nil || !reflect.DeepEqual(dirs, []string{"to", "to-x"}) {
+		t.Errorf("Unexpected directories %v (%v)", dirs, err)
+	}
+	if err := s.Rename("unconfirmed/token-hash", "avatars/hash"); err != nil {
+		t.Fatal(err)
+	}
+	data, modified, err := s.Read("avatars/hash")
+	if err != nil || string(data) != "data" || modified.IsZero() {
+		t.Errorf("Unexpected data after rename: %q, %v (%v)", data, modified, err)
+	}
+	if ok, _ := s.Exists("unconfirmed/token-hash"); ok {
+		t.Errorf("Renamed key should not exist anymore")
+	}
+	if err := s.Remove("avatars/hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("avatars/hash"); err != nil {
+		t.Errorf("Removing a missing key should not fail: %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	cleanup := useTempStorage(t)
+	defer cleanup()
+	testStorage(t, storage)
+
+	// a temporary file left behind by a crash is not listed
+	if err := storage.Write("avatars/hash", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*dataDir, "avatars", tempPrefix+"123"), []byte("da"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := storage.List("avatars"); err != nil || !reflect.DeepEqual(names, []string{"hash"}) {
+		t.Errorf("Unexpected list result %v (%v)", names, err)
+	}
+}
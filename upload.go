@@ -1,33 +1,39 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"gopkg.in/gomail.v1"
+	"html"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/smtp"
-	"os"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 )
 
-func validateAndResize(file io.Reader) (*Avatar, error) {
-	avatar, err := strictReadImage(file)
+// Reads the uploaded image, returning the untouched original and the master that is derived from it
+func validateAndResize(ctx context.Context, file io.Reader) (original *Avatar, master *Avatar, err error) {
+	original, err = strictReadImage(file)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	err = cropAndScale(avatar)
+	err = imageWork.run(ctx, func() (err error) {
+		master, err = cropAndScale(original)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return avatar, nil
+	return original, master, nil
 }
 
 func sendMessage(msg *gomail.Message) error {
@@ -67,7 +73,9 @@ func sendTestMail(email string) error {
 	return sendMessage(msg)
 }
 
-func sendConfirmationEmail(email string, token string) error {
+// Sends the confirmation email for an upload, identity is the OpenID URL of the avatar or empty for the avatar of
+// the email address
+func sendConfirmationEmail(email string, identity string, token string) error {
 	log.Printf("Sending confiration email to %v with confirmation token %v", email, token)
 	from := *sender
 	to := email
@@ -76,6 +84,10 @@ func sendConfirmationEmail(email string, token string) error {
 	url := getServiceURL() + "confirm/" + token
 	link := fmt.Sprintf("<a href=\"%s\">%s</a>", url, url)
 	body := "Thank you for uploading your avatar. You can confirm your upload by clicking this link: " + link
+	if identity != "" {
+		body = fmt.Sprintf("Thank you for uploading the avatar of OpenID URL %s. You can confirm your upload by "+
+			"clicking this link: %s", html.EscapeString(identity), link)
+	}
 
 	msg := gomail.NewMessage()
 	msg.SetHeader("From", from)
@@ -90,6 +102,9 @@ func sendConfirmationEmail(email string, token string) error {
 	return nil
 }
 
+// Confirmation tokens are created by createToken
+var tokenRegExp = regexp.MustCompile("^[0-9a-f]{32}$")
+
 func createToken() (string, error) {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
@@ -106,34 +121,72 @@ func renderSaveError(w http.ResponseWriter, message string, err error) {
 }
 
 func getConfirmationFile(token string) (_ string, hash string, err error) {
-	files, err := ioutil.ReadDir(getUnconfirmedDir())
+	if !tokenRegExp.MatchString(token) {
+		return "", "", errors.New("Invalid confirmation token")
+	}
+	dirs := []string{getUnconfirmedShardDir(token)}
+	if isMigrating() {
+		// the file may be migrated while it is looked up, so the shard is checked again if it is not found
+		dirs = append(dirs, getUnconfirmedDir(), getUnconfirmedShardDir(token))
+	}
+	for _, dir := range dirs {
+		filename, hash, err := findConfirmationFile(dir, token)
+		if filename != "" || err != nil {
+			return filename, hash, err
+		}
+	}
+	return "", "", errors.New("Confirmation period expired")
+}
+
+// Looks up the unconfirmed avatar for the token in dir, returning an empty filename if it is not found
+func findConfirmationFile(dir string, token string) (_ string, hash string, err error) {
+	files, err := storage.List(dir)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error listing unconfirmed avatars: %v", err)
+		return "", "", errors.New("Internal error")
 	}
 	for _, file := range files {
-		filename := file.Name()
-		if strings.HasPrefix(filename, token) {
-			splitted := strings.Split(filename, "-")
-			if len(splitted) < 2 {
+		// pending metadata and profiles are stored as <filename>.<extension>
+		filename := strings.SplitN(file, ".", 2)[0]
+		if strings.HasPrefix(filename, token+"-") {
+			hash = strings.TrimPrefix(filename, token+"-")
+			if !hashRegExp.MatchString(hash) {
 				log.Printf("Invalid confirmation file name: %v", filename)
 				return "", "", errors.New("Internal error")
 			}
-			hash = splitted[1] // FIXME perform range check!
-			return getUnconfirmedDir() + "/" + filename, hash, nil
+			return path.Join(dir, filename), hash, nil
 		}
 	}
-	return "", "", errors.New("Confirmation period expired")
+	return "", "", nil
+}
+
+// Registers the aliases of the email address and the email address for federation. This is only done once the
+// owner of the address confirmed an upload, since federation and grav.addresses trust the registered addresses.
+// Nothing is registered if the hash is not the hash of the email address, like for OpenID URLs.
+func registerConfirmedEmail(email string, hash string) error {
+	if email == "" || createHash(email) != hash {
+		return nil
+	}
+	if err := registerAliases(email); err != nil {
+		return err
+	}
+	return registerEmail(email)
 }
 
 func confirm(w http.ResponseWriter, r *http.Request, token string) {
 	log.Printf("Confirming uploaded avatar with token %v", token)
-	filepath, hash, err := getConfirmationFile(token)
-	log.Printf("Found confirmation file %v (hash=%v)", filepath, hash)
+	filename, hash, err := getConfirmationFile(token)
+	log.Printf("Found confirmation file %v (hash=%v)", filename, hash)
 	if err != nil {
 		renderSaveError(w, "Error confirming upload", err)
 		return
 	}
-	err = os.Rename(filepath, createAvatarPath(hash))
+	if keyExists(filename) {
+		err = promoteAvatar(filename, hash)
+	}
+	if err == nil {
+		err = confirmProfile(filename, hash)
+	}
 	if err != nil {
 		renderSaveError(w, "Error confirming upload", err)
 		return
@@ -147,24 +200,54 @@ func confirm(w http.ResponseWriter, r *http.Request, token string) {
 	renderTemplate(w, "confirm", map[string]string{"Avatar": fmt.Sprintf("/avatar/%s", hash), "Uniq": uniq})
 }
 
+// Returns the data for a form with an optional OpenID URL
+func openIDFormData() map[string]string {
+	data := map[string]string{}
+	if len(openIDHosts) > 0 {
+		data["OpenID"] = strings.Join(openIDHosts, ", ")
+	}
+	return data
+}
+
 func uploadHandler(w http.ResponseWriter, r *http.Request, title string) {
-	renderTemplate(w, "upload", map[string]string{})
+	renderTemplate(w, "upload", openIDFormData())
 }
 
 func confirmHandler(w http.ResponseWriter, r *http.Request, token string) {
 	confirm(w, r, token)
 }
 
-func writeToFile(filename string, avatar *Avatar) error {
-	f, err := os.Create(filename)
+// Returns the IP address of the client that sent the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return err
+		return r.RemoteAddr
 	}
-	defer f.Close()
+	return host
+}
+
+func writeToStorage(key string, avatar *Avatar) error {
+	return storage.Write(key, avatar.data)
+}
 
-	b := bytes.NewBuffer(avatar.data)
-	_, err = io.Copy(f, b)
-	return err
+// Returns the hash of the avatar that the email address manages via a form: the hash of the OpenID URL if one is
+// given, for which the email address must be the registered owner, and otherwise the hash of the email address.
+// The OpenID URL is returned normalized.
+func resolveFormHash(email string, openid string) (hash string, normalizedOpenID string, err error) {
+	if openid == "" {
+		return createHash(email), "", nil
+	}
+	normalized, err := normalizeOpenID(openid)
+	if err == nil {
+		err = verifyOpenID(normalized)
+	}
+	if err == nil {
+		err = verifyOpenIDOwner(normalized, email)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return createOpenIDHash(normalized), normalized, nil
 }
 
 func saveHandler(w http.ResponseWriter, r *http.Request, ignored string) {
@@ -174,30 +257,79 @@ func saveHandler(w http.ResponseWriter, r *http.Request, ignored string) {
 		renderSaveError(w, "Please use a valid email", err)
 		return
 	}
-	log.Printf("Saving image for email address: %v", email)
-	file, _, err := r.FormFile("image")
+	hash, openid, err := resolveFormHash(email, r.FormValue("openid"))
 	if err != nil {
-		renderSaveError(w, "Please chooce a file to upload", err)
+		renderSaveError(w, "Please use a valid OpenID URL", err)
 		return
 	}
-	avatar, err := validateAndResize(file)
+	if openid != "" {
+		log.Printf("Saving image for OpenID URL %v (confirmation by email address %v)", openid, email)
+	} else {
+		log.Printf("Saving image for email address: %v", email)
+	}
+	// the image may be omitted when only the profile is updated
+	profile, err := parseProfile(r)
 	if err != nil {
-		renderSaveError(w, "Failed to read image file. Note that only jpeg, png and gif images are supported", err)
+		renderSaveError(w, "Please use valid links", err)
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err == http.ErrMissingFile && !profile.isEmpty() {
+		file = nil
+	} else if err != nil {
+		renderSaveError(w, "Please chooce a file to upload", err)
+		return
+	}
+	// customized upload forms may not provide a rating
+	rating := defaultRating
+	if ratingParam := r.FormValue("rating"); ratingParam != "" {
+		rating = validRating(ratingParam)
+	}
+	if rating == "" {
+		renderSaveError(w, "Please choose a valid rating", fmt.Errorf("invalid rating '%s'", r.FormValue("rating")))
 		return
 	}
+	var original, avatar *Avatar
+	if file != nil {
+		original, avatar, err = validateAndResize(r.Context(), file)
+		if err == errBusy {
+			writeBusy(w)
+			return
+		}
+		if err != nil {
+			renderSaveError(w, "Failed to read image file. Note that only jpeg, png and gif images are supported", err)
+			return
+		}
+	}
 
 	token, err := createToken()
 	if err != nil {
 		renderSaveError(w, "Failed to generate random token", err)
 		return
 	}
-	hash := createHash(email)
 	filename := createUnconfirmedAvatarPath(hash, token)
 
-	err = writeToFile(filename, avatar)
-	if err != nil {
-		renderSaveError(w, "Error while creating file", err)
-		return
+	if avatar != nil {
+		err = writeAvatar(filename, original, avatar, Metadata{
+			Rating:   rating,
+			Email:    email,
+			IP:       clientIP(r),
+			Uploaded: time.Now().UTC(),
+			Token:    token,
+		})
+		if err != nil {
+			renderSaveError(w, "Error while creating file", err)
+			return
+		}
+	}
+	if !profile.isEmpty() {
+		// the email address is registered when the profile is confirmed, also without avatar
+		profile.Email = email
+		err = writeProfile(createPendingProfilePath(filename), profile)
+		if err != nil {
+			renderSaveError(w, "Error while creating file", err)
+			return
+		}
 	}
 
 	if *smtpHost == "" {
@@ -206,7 +338,7 @@ func saveHandler(w http.ResponseWriter, r *http.Request, ignored string) {
 		return
 	}
 
-	err = sendConfirmationEmail(email, token)
+	err = sendConfirmationEmail(email, openid, token)
 	if err != nil {
 		renderSaveError(w, "Failed to send confirmation email", err)
 		return
@@ -25,3 +25,22 @@ func TestVerifyEmail(t *testing.T) {
 			}
 		})
 }
+
+func TestConfirmationTokenExactMatch(t *testing.T) {
+	cleanup := useTempStorage(t)
+	defer cleanup()
+	hash := createHash("someone@example.com")
+	token := "0123456789abcdef0123456789abcdef"
+	pending := createUnconfirmedAvatarPath(hash, token)
+	if err := storage.Write(pending, []byte("pending")); err != nil {
+		t.Fatal(err)
+	}
+	if filename, found, err := getConfirmationFile(token); err != nil || filename != pending || found != hash {
+		t.Errorf("Expected %s for hash %s, got %s for %s (%v)", pending, hash, filename, found, err)
+	}
+	for _, prefix := range []string{"0123", "0", token[:31], token + "0"} {
+		if filename, _, err := getConfirmationFile(prefix); err == nil {
+			t.Errorf("Expected token %s to be rejected, got %s", prefix, filename)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Decoding, scaling and encoding images is done by a limited number of workers, so that a burst of uploads or of
+// requests for uncached sizes can't exhaust the CPUs and memory. Work that has to wait for a worker is queued, work
+// that doesn't fit in the queue is rejected and the request gets 503 Service Unavailable.
+
+// Returned if the image work queue is full
+var errBusy = errors.New("too many images are being processed, try again later")
+
+// Seconds after which a rejected request may be retried
+const retryAfter = "1"
+
+type workPool struct {
+	slots    chan struct{} // one for each running job, nil if the number of workers is unlimited
+	maxQueue int
+	mutex    sync.Mutex
+	queued   int
+	rejected int64
+}
+
+// Statistics of the pool, the queue depth is the number of queued jobs
+type workStats struct {
+	Workers  int   `json:"workers"`
+	Running  int   `json:"running"`
+	Queued   int   `json:"queued"`
+	MaxQueue int   `json:"maxQueue"`
+	Rejected int64 `json:"rejected"`
+}
+
+// The number of workers is unlimited until it is configured
+var imageWork = newWorkPool(0, 0)
+
+// Creates a pool with the number of workers (0 for unlimited) and the maximum number of jobs waiting for a worker
+func newWorkPool(workers int, maxQueue int) *workPool {
+	p := &workPool{maxQueue: maxQueue}
+	if workers > 0 {
+		p.slots = make(chan struct{}, workers)
+	}
+	return p
+}
+
+// Runs fn when a worker is available and returns its error. Returns errBusy without running fn if the queue is full,
+// and the error of the context if it is done while waiting for a worker, so that abandoned work leaves the queue.
+func (p *workPool) run(ctx context.Context, fn func() error) error {
+	if p.slots == nil {
+		return fn()
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.mutex.Lock()
+		if p.queued >= p.maxQueue {
+			p.rejected++
+			p.mutex.Unlock()
+			return errBusy
+		}
+		p.queued++
+		p.mutex.Unlock()
+
+		var err error
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		p.mutex.Lock()
+		p.queued--
+		p.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	defer func() { <-p.slots }()
+	return fn()
+}
+
+func (p *workPool) stats() workStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return workStats{Workers: cap(p.slots), Running: len(p.slots), Queued: p.queued, MaxQueue: p.maxQueue,
+		Rejected: p.rejected}
+}
+
+// Logs the queue depth and the number of rejected jobs at the interval if they changed, so that saturation of the
+// queue is visible without the API
+func logWorkStats(interval time.Duration) {
+	var last workStats
+	for range time.Tick(interval) {
+		stats := imageWork.stats()
+		if stats.Queued != last.Queued || stats.Rejected != last.Rejected {
+			log.Printf("Image work: %d of %d workers running, %d of %d jobs queued, %d rejected", stats.Running,
+				stats.Workers, stats.Queued, stats.MaxQueue, stats.Rejected)
+			last = stats
+		}
+	}
+}
+
+// Responds that the request can not be handled because there is too much image work
+func writeBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, errBusy.Error(), http.StatusServiceUnavailable)
+}
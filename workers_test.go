@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// occupies the workers of the pool until release is closed
+func occupyWorkers(p *workPool, workers int, release chan struct{}) {
+	for i := 0; i < workers; i++ {
+		go p.run(context.Background(), func() error {
+			<-release
+			return nil
+		})
+	}
+	for p.stats().Running < workers {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkPool(t *testing.T) {
+	p := newWorkPool(1, 1)
+	release := make(chan struct{})
+	occupyWorkers(p, 1, release)
+
+	done := make(chan error)
+	go func() { done <- p.run(context.Background(), func() error { return nil }) }()
+	for p.stats().Queued < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.run(context.Background(), func() error { return nil }); err != errBusy {
+		t.Errorf("Expected work to be rejected when the queue is full, got %v", err)
+	}
+	if stats := p.stats(); stats != (workStats{Workers: 1, Running: 1, Queued: 1, MaxQueue: 1, Rejected: 1}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected queued work to run, got %v", err)
+	}
+}
+
+func TestWorkPoolCancel(t *testing.T) {
+	p := newWorkPool(1, 1)
+	release := make(chan struct{})
+	occupyWorkers(p, 1, release)
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	ran := false
+	go func() { done <- p.run(ctx, func() error { ran = true; return nil }) }()
+	for p.stats().Queued < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled || ran {
+		t.Errorf("Expected cancelled work to leave the queue without running, got %v", err)
+	}
+	if queued := p.stats().Queued; queued != 0 {
+		t.Errorf("Expected empty queue after cancel, got %d", queued)
+	}
+}
+
+func TestBusy(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(p *workPool) { imageWork = p }(imageWork)
+	imageWork = newWorkPool(1, 0)
+	release := make(chan struct{})
+	occupyWorkers(imageWork, 1, release)
+	defer close(release)
+
+	w := requestAvatar("/avatar/" + hash)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After, got %d", w.Code)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implementation of the Gravatar XML-RPC API (https://en.gravatar.com/site/implement/xmlrpc/) so that clients
+// that manage avatars through this API can be used with intravatar.
+//
+// The account is identified by the 'user' parameter, the hash of the email address. Instead of the Gravatar
+// password, the password is compared with the configured API token. Without a valid token only the methods
+// that don't reveal, store or delete anything are allowed, and stored images are only used for the address of the
+// account after confirmation by email. Since storing an image requires the token, clients need the token to upload
+// new images.
+
+// Fault codes as used by Gravatar
+const (
+	faultInvalidRequest = -7
+	faultAuthentication = -8
+	faultNotFound       = -9
+	faultInternal       = -10
+)
+
+var hashRegExp = regexp.MustCompile("^([0-9a-f]{32}|[0-9a-f]{64})$")
+
+// Userimages are named by the MD5 hash of their data
+var userimageRegExp = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// Maximum size of a request. The request is read before the password is checked, so this limits the memory that
+// clients without the API token can use.
+var xmlrpcMaxRequestSize int64 = 16 << 20
+
+type xmlrpcFault struct {
+	code    int
+	message string
+}
+
+func (f *xmlrpcFault) Error() string {
+	return f.message
+}
+
+type xmlrpcMember struct {
+	Name  string      `xml:"name"`
+	Value xmlrpcValue `xml:"value"`
+}
+
+// Value as it appears in a method call, only one of the fields is set
+type xmlrpcValue struct {
+	String  *string `xml:"string"`
+	Int     *string `xml:"int"`
+	I4      *string `xml:"i4"`
+	Boolean *string `xml:"boolean"`
+	Double  *string `xml:"double"`
+	Base64  *string `xml:"base64"`
+	Array   *struct {
+		Values []xmlrpcValue `xml:"data>value"`
+	} `xml:"array"`
+	Struct *struct {
+		Members []xmlrpcMember `xml:"member"`
+	} `xml:"struct"`
+	Text string `xml:",chardata"`
+}
+
+type xmlrpcCall struct {
+	Method string        `xml:"methodName"`
+	Params []xmlrpcValue `xml:"params>param>value"`
+}
+
+// converts the value to a string, int, bool, float64, []byte, []interface{} or map[string]interface{}
+func (v xmlrpcValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil || v.I4 != nil:
+		s := v.Int
+		if s == nil {
+			s = v.I4
+		}
+		return strconv.Atoi(strings.TrimSpace(*s))
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.Base64 != nil:
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(*v.Base64), ""))
+	case v.Array != nil:
+		values := []interface{}{}
+		for _, value := range v.Array.Values {
+			decoded, err := value.decode()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, decoded)
+		}
+		return values, nil
+	case v.Struct != nil:
+		members := map[string]interface{}{}
+		for _, member := range v.Struct.Members {
+			decoded, err := member.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			members[member.Name] = decoded
+		}
+		return members, nil
+	}
+	// a value without type is a string
+	return v.Text, nil
+}
+
+func encodeValue(b *bytes.Buffer, value interface{}) {
+	b.WriteString("<value>")
+	switch v := value.(type) {
+	case string:
+		b.WriteString("<string>")
+		xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>")
+	case int:
+		fmt.Fprintf(b, "<int>%d</int>", v)
+	case bool:
+		if v {
+			b.WriteString("<boolean>1</boolean>")
+		} else {
+			b.WriteString("<boolean>0</boolean>")
+		}
+	case []interface{}:
+		b.WriteString("<array><data>")
+		for _, element := range v {
+			encodeValue(b, element)
+		}
+		b.WriteString("</data></array>")
+	case map[string]interface{}:
+		var names []string
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString("<struct>")
+		for _, name := range names {
+			b.WriteString("<member><name>")
+			xml.EscapeText(b, []byte(name))
+			b.WriteString("</name>")
+			encodeValue(b, v[name])
+			b.WriteString("</member>")
+		}
+		b.WriteString("</struct>")
+	}
+	b.WriteString("</value>")
+}
+
+func writeXmlrpcResponse(w http.ResponseWriter, result interface{}, err error) {
+	if err == errBusy {
+		writeBusy(w)
+		return
+	}
+	b := new(bytes.Buffer)
+	b.WriteString(xml.Header + "<methodResponse>")
+	if err != nil {
+		fault, ok := err.(*xmlrpcFault)
+		if !ok {
+			fault = &xmlrpcFault{faultInternal, err.Error()}
+		}
+		b.WriteString("<fault>")
+		encodeValue(b, map[string]interface{}{"faultCode": fault.code, "faultString": fault.message})
+		b.WriteString("</fault>")
+	} else {
+		b.WriteString("<params><param>")
+		encodeValue(b, result)
+		b.WriteString("</param></params>")
+	}
+	b.WriteString("</methodResponse>")
+	w.Header().Set("Content-Type", "text/xml")
+	io.Copy(w, b)
+}
+
+// Context of an XML-RPC method call
+type xmlrpcContext struct {
+	user  string // hash of the email of the account
+	admin bool   // true if the call is authenticated with the API token
+	ip    string // IP address of the client
+	args  map[string]interface{}
+	ctx   context.Context // context of the request
+}
+
+func (c *xmlrpcContext) requireAdmin() error {
+	if !c.admin {
+		return &xmlrpcFault{faultAuthentication, "Error validating password"}
+	}
+	return nil
+}
+
+func (c *xmlrpcContext) stringArg(name string) (string, error) {
+	if s, ok := c.args[name].(string); ok {
+		return s, nil
+	}
+	return "", &xmlrpcFault{faultInvalidRequest, fmt.Sprintf("Missing or invalid parameter '%s'", name)}
+}
+
+func (c *xmlrpcContext) stringsArg(name string) ([]string, error) {
+	values, ok := c.args[name].([]interface{})
+	if !ok {
+		return nil, &xmlrpcFault{faultInvalidRequest, fmt.Sprintf("Missing or invalid parameter '%s'", name)}
+	}
+	var result []string
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, &xmlrpcFault{faultInvalidRequest, fmt.Sprintf("Invalid element in parameter '%s'", name)}
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+type xmlrpcMethod func(c *xmlrpcContext) (interface{}, error)
+
+var xmlrpcMethods = map[string]xmlrpcMethod{
+	"grav.test":            gravTest,
+	"grav.exists":          gravExists,
+	"grav.addresses":       gravAddresses,
+	"grav.userimages":      gravUserimages,
+	"grav.saveData":        gravSaveData,
+	"grav.useUserimage":    gravUseUserimage,
+	"grav.removeImage":     gravRemoveImage,
+	"grav.deleteUserimage": gravDeleteUserimage,
+}
+
+func getUserimagesDir(user string) string {
+	return getStoreDir("userimages", user)
+}
+
+func createUserimagePath(user string, userimage string) string {
+	return path.Join(getUserimagesDir(user), userimage)
+}
+
+// Verifies the user and userimage before they are used in a key, so that they can't refer to keys outside the
+// userimages of the user
+func verifyUserimage(user string, userimage string) error {
+	if !hashRegExp.MatchString(user) {
+		return &xmlrpcFault{faultInvalidRequest, "Invalid parameter 'user'"}
+	}
+	if !userimageRegExp.MatchString(userimage) {
+		return &xmlrpcFault{faultInvalidRequest, "Invalid parameter 'userimage'"}
+	}
+	return nil
+}
+
+func getUserimageURL(user string, userimage string) string {
+	return getServiceURL() + "userimage/" + user + "/" + userimage
+}
+
+// Ratings are passed as numbers in the XML-RPC API
+func ratingFromNumber(value interface{}) (string, error) {
+	n, ok := value.(int)
+	if !ok || n < 0 || n >= len(ratings) {
+		return "", &xmlrpcFault{faultInvalidRequest, "Invalid rating"}
+	}
+	return ratings[n], nil
+}
+
+func gravTest(c *xmlrpcContext) (interface{}, error) {
+	return map[string]interface{}{"response": int(1)}, nil
+}
+
+func gravExists(c *xmlrpcContext) (interface{}, error) {
+	hashes, err := c.stringsArg("hashes")
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	for _, hash := range hashes {
+		normalized := strings.ToLower(hash)
+		result[hash] = boolToInt(hashRegExp.MatchString(normalized) && keyExists(createAvatarPath(resolveHash(normalized))))
+	}
+	return result, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// The only address of an account is the email of which the user hash is derived
+func gravAddresses(c *xmlrpcContext) (interface{}, error) {
+	if err := c.requireAdmin(); err != nil {
+		return nil, err
+	}
+	email := lookupEmail(c.user)
+	if email == "" {
+		return map[string]interface{}{}, nil
+	}
+	address := map[string]interface{}{"rating": 0, "userimage": "", "userimage_url": ""}
+	avatarPath := createAvatarPath(c.user)
+	if keyExists(avatarPath) {
+		metadata := readMetadata(avatarPath)
+		address["rating"] = ratingLevel(metadata.Rating)
+		if metadata.Userimage != "" {
+			address["userimage"] = metadata.Userimage
+			address["userimage_url"] = getUserimageURL(c.user, metadata.Userimage)
+		}
+	}
+	return map[string]interface{}{email: address}, nil
+}
+
+func gravUserimages(c *xmlrpcContext) (interface{}, error) {
+	if err := c.requireAdmin(); err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	files, err := storage.List(getUserimagesDir(c.user))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.Contains(file, ".") {
+			continue
+		}
+		metadata := readMetadata(createUserimagePath(c.user, file))
+		result[file] = []interface{}{ratingLevel(metadata.Rating), getUserimageURL(c.user, file)}
+	}
+	return result, nil
+}
+
+// Stores the image for the account, it is not used until useUserimage is called. Requires the API token since
+// userimages are kept until they are deleted and are publicly available.
+func gravSaveData(c *xmlrpcContext) (interface{}, error) {
+	if err := c.requireAdmin(); err != nil {
+		return nil, err
+	}
+	data, ok := c.args["data"].([]byte)
+	if !ok {
+		return nil, &xmlrpcFault{faultInvalidRequest, "Missing or invalid parameter 'data'"}
+	}
+	rating, err := ratingFromNumber(c.args["rating"])
+	if err != nil {
+		return nil, err
+	}
+	original, avatar, err := validateAndResize(c.ctx, bytes.NewReader(data))
+	if err == errBusy {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &xmlrpcFault{faultInvalidRequest, "Failed to read image: " + err.Error()}
+	}
+	userimage := fmt.Sprintf("%x", md5.Sum(original.data))
+	metadata := Metadata{Rating: rating, IP: c.ip, Uploaded: time.Now().UTC()}
+	if err := writeAvatar(createUserimagePath(c.user, userimage), original, avatar, metadata); err != nil {
+		return nil, err
+	}
+	return userimage, nil
+}
+
+// Returns the original (nil if not stored), master and metadata of the userimage
+func readUserimage(user string, userimage string) (*Avatar, *Avatar, Metadata, error) {
+	if err := verifyUserimage(user, userimage); err != nil {
+		return nil, nil, Metadata{}, err
+	}
+	filename := createUserimagePath(user, userimage)
+	data, err := readKey(filename)
+	if err != nil {
+		return nil, nil, Metadata{}, &xmlrpcFault{faultNotFound, "Userimage not found"}
+	}
+	var original *Avatar
+	if originalData, err := readKey(filename + originalSuffix); err == nil {
+		original = &Avatar{size: -1, data: originalData}
+	}
+	metadata := readMetadata(filename)
+	metadata.Userimage = userimage
+	return original, &Avatar{size: -1, data: data}, metadata, nil
+}
+
+// Uses the image for the addresses. With the API token the image is used immediately, otherwise only the address
+// of the account can be used and a confirmation email is sent.
+func gravUseUserimage(c *xmlrpcContext) (interface{}, error) {
+	userimage, err := c.stringArg("userimage")
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := c.stringsArg("addresses")
+	if err != nil {
+		return nil, err
+	}
+	original, avatar, metadata, err := readUserimage(c.user, userimage)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	for _, address := range addresses {
+		hash := createHash(address)
+		if !c.admin && (hash != c.user || verifyEmail(address) != nil) {
+			result[address] = false
+			continue
+		}
+		// without the API token the address is registered when the upload is confirmed
+		var err error
+		metadata.Email = address
+		if c.admin {
+			metadata.Confirmed = time.Now().UTC()
+			err = registerConfirmedEmail(address, hash)
+			if err == nil {
+				unlock := lockAvatar(hash)
+				err = replaceCurrentAvatar(hash, func(key string) error {
+					return writeAvatar(key, original, avatar, metadata)
+				})
+				unlock()
+			}
+		} else {
+			err = requestConfirmation(address, hash, original, avatar, metadata)
+		}
+		if err != nil {
+			log.Printf("Failed to use userimage %s for %s: %v", userimage, address, err)
+		}
+		result[address] = err == nil
+	}
+	return result, nil
+}
+
+// Stores the avatar as unconfirmed upload and sends the confirmation email, or confirms immediately if email is
+// not configured
+func requestConfirmation(email string, hash string, original *Avatar, avatar *Avatar, metadata Metadata) error {
+	token, err := createToken()
+	if err != nil {
+		return err
+	}
+	filename := createUnconfirmedAvatarPath(hash, token)
+	metadata.Token = token
+	if err := writeAvatar(filename, original, avatar, metadata); err != nil {
+		return err
+	}
+	if *smtpHost == "" {
+		return promoteAvatar(filename, hash)
+	}
+	return sendConfirmationEmail(email, "", token)
+}
+
+func gravRemoveImage(c *xmlrpcContext) (interface{}, error) {
+	if err := c.requireAdmin(); err != nil {
+		return nil, err
+	}
+	addresses, err := c.stringsArg("addresses")
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	for _, address := range addresses {
+		hash := createHash(address)
+		filename := createAvatarPath(hash)
+		unlock := lockAvatar(hash)
+		result[address] = keyExists(filename) && removeAvatar(filename) == nil
+		unlock()
+	}
+	return result, nil
+}
+
+func gravDeleteUserimage(c *xmlrpcContext) (interface{}, error) {
+	if err := c.requireAdmin(); err != nil {
+		return nil, err
+	}
+	userimage, err := c.stringArg("userimage")
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyUserimage(c.user, userimage); err != nil {
+		return nil, err
+	}
+	filename := createUserimagePath(c.user, userimage)
+	return keyExists(filename) && removeAvatar(filename) == nil, nil
+}
+
+func isValidToken(password string) bool {
+	return *apiToken != "" && subtle.ConstantTimeCompare([]byte(password), []byte(*apiToken)) == 1
+}
+
+func parseXmlrpcCall(w http.ResponseWriter, r *http.Request) (*xmlrpcCall, map[string]interface{}, error) {
+	call := &xmlrpcCall{}
+	if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, xmlrpcMaxRequestSize)).Decode(call); err != nil {
+		return nil, nil, &xmlrpcFault{faultInvalidRequest, "Invalid XML-RPC request: " + err.Error()}
+	}
+	// Gravatar passes all arguments as members of a single struct
+	args := map[string]interface{}{}
+	if len(call.Params) > 0 {
+		decoded, err := call.Params[0].decode()
+		if err != nil {
+			return nil, nil, &xmlrpcFault{faultInvalidRequest, "Invalid XML-RPC request: " + err.Error()}
+		}
+		if members, ok := decoded.(map[string]interface{}); ok {
+			args = members
+		}
+	}
+	return call, args, nil
+}
+
+func xmlrpcHandler(w http.ResponseWriter, r *http.Request, ignored string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := strings.ToLower(r.URL.Query().Get("user"))
+	call, args, err := parseXmlrpcCall(w, r)
+	if err == nil && !hashRegExp.MatchString(user) {
+		err = &xmlrpcFault{faultInvalidRequest, "Missing or invalid parameter 'user'"}
+	}
+	if err != nil {
+		writeXmlrpcResponse(w, nil, err)
+		return
+	}
+	method, ok := xmlrpcMethods[call.Method]
+	if !ok {
+		writeXmlrpcResponse(w, nil, &xmlrpcFault{faultInvalidRequest, "Unknown method " + call.Method})
+		return
+	}
+	password, _ := args["password"].(string)
+	c := &xmlrpcContext{user: resolveHash(user), admin: isValidToken(password), ip: clientIP(r), args: args,
+		ctx: r.Context()}
+	log.Printf("XML-RPC call %s for user %s (admin=%v)", call.Method, user, c.admin)
+	result, err := method(c)
+	writeXmlrpcResponse(w, result, err)
+}
+
+// Serves a userimage in its stored size, title is <user>/<userimage>
+func userimageHandler(w http.ResponseWriter, r *http.Request, title string) {
+	splitted := strings.Split(title, "/")
+	data, err := readKey(createUserimagePath(splitted[0], splitted[1]))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeAvatarResult(w, r, &Avatar{data: data, cacheControl: "max-age=300"})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func callXmlrpc(user string, body string) string {
+	w := httptest.NewRecorder()
+	xmlrpcHandler(w, httptest.NewRequest("POST", "/xmlrpc?user="+user, strings.NewReader(body)), "xmlrpc")
+	return w.Body.String()
+}
+
+func xmlrpcRequest(method string, members string) string {
+	return "<?xml version=\"1.0\"?><methodCall><methodName>" + method + "</methodName><params><param><value><struct>" +
+		members + "</struct></value></param></params></methodCall>"
+}
+
+func TestXmlrpc(t *testing.T) {
+	hash, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(token string) { *apiToken = token }(*apiToken)
+	*apiToken = "secret"
+	data, err := readKey(createAvatarPath(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := "other@example.com"
+	user := createHash(email)
+
+	response := callXmlrpc(user, xmlrpcRequest("grav.exists",
+		"<member><name>hashes</name><value><array><data><value><string>"+hash+"</string></value><value>"+user+
+			"</value></data></array></value></member>"))
+	if !strings.Contains(response, "<name>"+hash+"</name><value><int>1</int>") ||
+		!strings.Contains(response, "<name>"+user+"</name><value><int>0</int>") {
+		t.Errorf("Unexpected response for grav.exists: %s", response)
+	}
+
+	response = callXmlrpc(user, xmlrpcRequest("grav.userimages", "<member><name>password</name><value>wrong</value></member>"))
+	if !strings.Contains(response, "<fault>") {
+		t.Errorf("Expected fault for invalid password: %s", response)
+	}
+
+	saveData := "<member><name>data</name><value><base64>" + base64.StdEncoding.EncodeToString(data) + "</base64></value></member>" +
+		"<member><name>rating</name><value><int>1</int></value></member>"
+	response = callXmlrpc(user, xmlrpcRequest("grav.saveData", saveData))
+	if !strings.Contains(response, "<fault>") {
+		t.Errorf("Expected fault for saving data without password: %s", response)
+	}
+
+	response = callXmlrpc(user, xmlrpcRequest("grav.saveData",
+		saveData+"<member><name>password</name><value><string>secret</string></value></member>"))
+	start := strings.Index(response, "<string>")
+	end := strings.Index(response, "</string>")
+	if start < 0 || end < start {
+		t.Fatalf("Unexpected response for grav.saveData: %s", response)
+	}
+	userimage := response[start+len("<string>") : end]
+
+	response = callXmlrpc(user, xmlrpcRequest("grav.useUserimage",
+		"<member><name>userimage</name><value><string>"+userimage+"</string></value></member>"+
+			"<member><name>addresses</name><value><array><data><value><string>"+email+"</string></value></data></array></value></member>"+
+			"<member><name>password</name><value><string>secret</string></value></member>"))
+	if !strings.Contains(response, "<boolean>1</boolean>") {
+		t.Errorf("Unexpected response for grav.useUserimage: %s", response)
+	}
+	if metadata := readMetadata(createAvatarPath(user)); metadata.Rating != "pg" || metadata.Userimage != userimage {
+		t.Errorf("Unexpected metadata of used userimage: %v", metadata)
+	}
+}
+
+func TestXmlrpcUserimageTraversal(t *testing.T) {
+	defer useTempStorage(t)()
+	email := "someone@example.com"
+	user := createHash(email)
+	// stored outside the userimages of the user
+	if err := writeAvatar("secret", nil, createPortrait(64, 64), Metadata{Rating: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	response := callXmlrpc(user, xmlrpcRequest("grav.useUserimage",
+		"<member><name>userimage</name><value><string>../../secret</string></value></member>"+
+			"<member><name>addresses</name><value><array><data><value><string>"+email+"</string></value></data></array></value></member>"))
+	if !strings.Contains(response, "<fault>") {
+		t.Errorf("Expected fault for userimage outside the userimages of the user: %s", response)
+	}
+	if keyExists(createAvatarPath(user)) {
+		t.Errorf("Expected no avatar to be stored for %s", user)
+	}
+}
+
+func TestXmlrpcRequestSize(t *testing.T) {
+	_, cleanup := setupDataDir(t)
+	defer cleanup()
+	defer func(size int64) { xmlrpcMaxRequestSize = size }(xmlrpcMaxRequestSize)
+	xmlrpcMaxRequestSize = 1024
+
+	saveData := "<member><name>data</name><value><base64>" + strings.Repeat("A", 2048) + "</base64></value></member>"
+	response := callXmlrpc(createHash("someone@example.com"), xmlrpcRequest("grav.saveData", saveData))
+	if !strings.Contains(response, "<fault>") || !strings.Contains(response, "too large") {
+		t.Errorf("Expected fault for too large request: %s", response)
+	}
+}